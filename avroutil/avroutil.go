@@ -0,0 +1,24 @@
+// Package avroutil provides helpers to stream Avro data as JSON with writer package.
+package avroutil
+
+import (
+	"encoding/json"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+// Codec converts Avro native data into Avro JSON.
+// It is the TextualFromNative method of *goavro.Codec, so a codec created by goavro.NewCodec can be passed as it is.
+type Codec interface {
+	TextualFromNative(buf []byte, datum interface{}) ([]byte, error)
+}
+
+// WriteAvroElement converts datum to JSON with codec and writes it as an array element.
+func WriteAvroElement(ew writer.ElementWriter, datum interface{}, codec Codec) error {
+	jsn, err := codec.TextualFromNative(nil, datum)
+	if err != nil {
+		return err
+	}
+
+	return ew.WriteElement(json.RawMessage(jsn))
+}
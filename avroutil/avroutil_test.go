@@ -0,0 +1,84 @@
+package avroutil_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/avroutil"
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+// recordCodec is a fake Codec for a record schema {"name": string, "age": ["null", "int"]}.
+type recordCodec struct{}
+
+func (recordCodec) TextualFromNative(buf []byte, datum interface{}) ([]byte, error) {
+	m, ok := datum.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot encode %T as record", datum)
+	}
+
+	// union values are wrapped with their type name in Avro JSON.
+	var age interface{}
+	if a, ok := m["age"]; ok && a != nil {
+		age = map[string]interface{}{"int": a}
+	}
+
+	jsn, err := json.Marshal(map[string]interface{}{
+		"name": m["name"],
+		"age":  age,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append(buf, jsn...), nil
+}
+
+func TestWriteAvroElement(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	root := struct {
+		Records *writer.Value
+	}{
+		Records: w.MustNewArrayValue("records", func(ew writer.ElementWriter) error {
+			records := []map[string]interface{}{
+				{"name": "alice", "age": 20},
+				{"name": "bob"},
+			}
+			for _, r := range records {
+				if err := avroutil.WriteAvroElement(ew, r, recordCodec{}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Records":[{"age":{"int":20},"name":"alice"},{"age":null,"name":"bob"}]}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWriteAvroElementError(t *testing.T) {
+	w := writer.New(new(bytes.Buffer))
+
+	root := struct {
+		Records *writer.Value
+	}{
+		Records: w.MustNewArrayValue("records", func(ew writer.ElementWriter) error {
+			return avroutil.WriteAvroElement(ew, "not a record", recordCodec{})
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err == nil {
+		t.Fatal("error expected")
+	}
+}
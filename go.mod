@@ -1,3 +1,3 @@
 module github.com/knightso/json-partial-streaming
 
-go 1.16
+go 1.18
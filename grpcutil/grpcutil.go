@@ -0,0 +1,35 @@
+// Package grpcutil provides helpers to stream gRPC responses as JSON with writer package.
+package grpcutil
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+// StreamGRPC writes messages received from a gRPC server-streaming response as array elements.
+// recv is typically the Recv method of the client stream, and it is called until it returns io.EOF.
+// marshal encodes each message to JSON, e.g. protojson.Marshal.
+// Only marshal handles the messages, so T is left unconstrained, and messages of any protobuf runtime work.
+func StreamGRPC[T any](ew writer.ElementWriter, recv func() (T, error), marshal func(T) ([]byte, error)) error {
+	for {
+		m, err := recv()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		jsn, err := marshal(m)
+		if err != nil {
+			return err
+		}
+
+		if err := ew.WriteElement(json.RawMessage(jsn)); err != nil {
+			return err
+		}
+	}
+}
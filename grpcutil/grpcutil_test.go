@@ -0,0 +1,74 @@
+package grpcutil_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/grpcutil"
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+type message struct {
+	id   int
+	name string
+}
+
+func marshalMessage(m *message) ([]byte, error) {
+	return []byte(fmt.Sprintf(`{"id":%d,"name":%q}`, m.id, m.name)), nil
+}
+
+func TestStreamGRPC(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	msgs := []*message{{id: 1, name: "a"}, {id: 2, name: "b"}}
+	recv := func() (*message, error) {
+		if len(msgs) == 0 {
+			return nil, io.EOF
+		}
+		m := msgs[0]
+		msgs = msgs[1:]
+		return m, nil
+	}
+
+	root := struct {
+		Messages *writer.Value
+	}{
+		Messages: w.MustNewArrayValue("messages", func(ew writer.ElementWriter) error {
+			return grpcutil.StreamGRPC(ew, recv, marshalMessage)
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"Messages":[{"id":1,"name":"a"},{"id":2,"name":"b"}]}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestStreamGRPCError(t *testing.T) {
+	w := writer.New(new(bytes.Buffer))
+
+	errRecv := errors.New("stream broken")
+	recv := func() (*message, error) {
+		return nil, errRecv
+	}
+
+	root := struct {
+		Messages *writer.Value
+	}{
+		Messages: w.MustNewArrayValue("messages", func(ew writer.ElementWriter) error {
+			return grpcutil.StreamGRPC(ew, recv, marshalMessage)
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); !errors.Is(err, errRecv) {
+		t.Fatalf("%v expected, but was %v", errRecv, err)
+	}
+}
@@ -0,0 +1,85 @@
+// Package otelutil records OpenTelemetry metrics of the values streamed with writer package.
+package otelutil
+
+import (
+	"context"
+	"time"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+// Counter is the subset of an OpenTelemetry metric.Int64Counter used by Metrics.
+// The measurement options of metric.Int64Counter.Add make it a different method, so wrap the instrument with CounterFunc,
+// e.g. otelutil.CounterFunc(func(ctx context.Context, incr int64) { c.Add(ctx, incr) }).
+type Counter interface {
+	Add(ctx context.Context, incr int64)
+}
+
+// CounterFunc is an adapter to use a function as a Counter.
+type CounterFunc func(ctx context.Context, incr int64)
+
+// Add calls f(ctx, incr).
+func (f CounterFunc) Add(ctx context.Context, incr int64) {
+	f(ctx, incr)
+}
+
+// Histogram is the subset of an OpenTelemetry metric.Float64Histogram used by Metrics.
+// Like Counter, wrap the instrument with HistogramFunc.
+type Histogram interface {
+	Record(ctx context.Context, value float64)
+}
+
+// HistogramFunc is an adapter to use a function as a Histogram.
+type HistogramFunc func(ctx context.Context, value float64)
+
+// Record calls f(ctx, value).
+func (f HistogramFunc) Record(ctx context.Context, value float64) {
+	f(ctx, value)
+}
+
+// Metrics is the set of instruments recording the values expanded by a Writer. Nil instruments are skipped.
+// The instruments are not given the keys as attributes, since keys are often unique per document.
+type Metrics struct {
+	// Values counts the values expanded.
+	Values Counter
+	// Errors counts the values whose expansion failed.
+	Errors Counter
+	// Bytes counts the bytes written in place of the placeholders, as Writer.BytesByKey does,
+	// so the bytes of nested values are counted for their parents as well.
+	Bytes Counter
+	// Duration records the seconds taken to expand each value.
+	Duration Histogram
+}
+
+// WithMetrics records m through writer.WithValueHookCtx, in addition to the other hooks given to the Writer.
+// The instruments are given the context each value is streamed with.
+func WithMetrics(m Metrics) writer.Option {
+	return func(w *writer.Writer) {
+		writer.WithValueHookCtx(m.hook(w))(w)
+	}
+}
+
+func (m Metrics) hook(w *writer.Writer) func(ctx context.Context, key string) func(err error) {
+	return func(ctx context.Context, key string) func(err error) {
+		start := time.Now()
+		var before int64
+		if m.Bytes != nil {
+			before = w.BytesByKey()[key]
+		}
+
+		return func(err error) {
+			if m.Values != nil {
+				m.Values.Add(ctx, 1)
+			}
+			if err != nil && m.Errors != nil {
+				m.Errors.Add(ctx, 1)
+			}
+			if m.Bytes != nil {
+				m.Bytes.Add(ctx, w.BytesByKey()[key]-before)
+			}
+			if m.Duration != nil {
+				m.Duration.Record(ctx, time.Since(start).Seconds())
+			}
+		}
+	}
+}
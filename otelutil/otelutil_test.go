@@ -0,0 +1,100 @@
+package otelutil_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/otelutil"
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+// memMeter is an in-memory meter keeping the measurements of its instruments.
+type memMeter struct {
+	mu      sync.Mutex
+	sums    map[string]int64
+	records map[string][]float64
+}
+
+func newMemMeter() *memMeter {
+	return &memMeter{sums: map[string]int64{}, records: map[string][]float64{}}
+}
+
+func (m *memMeter) counter(name string) otelutil.Counter {
+	return otelutil.CounterFunc(func(ctx context.Context, incr int64) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.sums[name] += incr
+	})
+}
+
+func (m *memMeter) histogram(name string) otelutil.Histogram {
+	return otelutil.HistogramFunc(func(ctx context.Context, value float64) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.records[name] = append(m.records[name], value)
+	})
+}
+
+type ctxKey struct{}
+
+func TestWithMetrics(t *testing.T) {
+	meter := newMemMeter()
+
+	var hooked []string
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+	w := writer.New(io.Discard,
+		writer.WithContext(ctx),
+		writer.WithValueHook(func(key string) func(err error) {
+			hooked = append(hooked, key)
+			return nil
+		}),
+		otelutil.WithMetrics(otelutil.Metrics{
+			Values: otelutil.CounterFunc(func(ctx context.Context, incr int64) {
+				// the measurements are given the context of the request.
+				if ctx.Value(ctxKey{}) != "request" {
+					t.Errorf("the streaming context expected, but was %v", ctx)
+				}
+				meter.counter("values").Add(ctx, incr)
+			}),
+			Errors:   meter.counter("errors"),
+			Bytes:    meter.counter("bytes"),
+			Duration: meter.histogram("duration"),
+		}),
+	)
+
+	a := w.MustNewValue("a", func(w io.Writer) error {
+		_, err := fmt.Fprint(w, `"abc"`)
+		return err
+	})
+	b := w.MustNewValue("b", func(w io.Writer) error {
+		_, err := fmt.Fprint(w, 12)
+		return err
+	})
+	if err := w.Encode([]*writer.Value{a, b, a}); err != nil {
+		t.Fatal(err)
+	}
+
+	failing := w.MustNewValue("failing", func(w io.Writer) error {
+		return fmt.Errorf("failed")
+	})
+	if err := w.Encode(failing); err == nil {
+		t.Fatal("error expected")
+	}
+
+	for name, expected := range map[string]int64{"values": 4, "errors": 1, "bytes": 12} {
+		if actual := meter.sums[name]; actual != expected {
+			t.Errorf("%s expected:%d, but was %d", name, expected, actual)
+		}
+	}
+	if n := len(meter.records["duration"]); n != 4 {
+		t.Errorf("4 durations expected, but was %d", n)
+	}
+
+	// the hook given before WithMetrics is kept.
+	if expected, actual := "[a b a failing]", fmt.Sprint(hooked); actual != expected {
+		t.Errorf("hooked keys expected:%s, but was %s", expected, actual)
+	}
+}
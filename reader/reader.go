@@ -0,0 +1,67 @@
+// Package reader resolves placeholders in JSON documents on read.
+// It is the counterpart of writer package: a producer encodes a document with the placeholders of writer.Value
+// by plain json.Marshal, and a consumer resolves them with its own handlers.
+package reader
+
+import (
+	"io"
+	"sync"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+// Reader reads a JSON document from the underlying reader, in which placeholders are replaced
+// with the output of the handlers registered by Handle.
+type Reader struct {
+	src  io.Reader
+	w    *writer.Writer
+	pr   *io.PipeReader
+	pw   *io.PipeWriter
+	once sync.Once
+}
+
+// New creates new Reader which reads r.
+// opts are passed to writer.New, e.g. writer.WithMarker when the producer uses it.
+func New(r io.Reader, opts ...writer.Option) *Reader {
+	pr, pw := io.Pipe()
+	return &Reader{
+		src: r,
+		w:   writer.New(pw, opts...),
+		pr:  pr,
+		pw:  pw,
+	}
+}
+
+// Handle registers f which writes the value in place of the placeholder of key.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (r *Reader) Handle(key string, f writer.ValueFunc) error {
+	_, err := r.w.NewValue(key, f)
+	return err
+}
+
+// MustHandle registers f which writes the value in place of the placeholder of key.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (r *Reader) MustHandle(key string, f writer.ValueFunc) {
+	r.w.MustNewValue(key, f)
+}
+
+// Read reads the resolved document.
+// writer.ErrUnknownKey is returned when a placeholder without handler is reached.
+func (r *Reader) Read(p []byte) (int, error) {
+	r.once.Do(func() {
+		go func() {
+			_, err := io.Copy(r.w, r.src)
+			r.pw.CloseWithError(err)
+		}()
+	})
+
+	return r.pr.Read(p)
+}
+
+// Close stops reading the underlying reader.
+// It should be called when the document is not read until the end.
+func (r *Reader) Close() error {
+	return r.pr.Close()
+}
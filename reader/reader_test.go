@@ -0,0 +1,107 @@
+package reader_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/reader"
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+func TestRead(t *testing.T) {
+	// the producer puts placeholders by plain json.Marshal.
+	producer := writer.New(ioutil.Discard)
+
+	type Child struct {
+		Name   string
+		Values *writer.Value
+	}
+
+	type Parent struct {
+		Name     string
+		Value    *writer.Value
+		Children []*Child
+		Quoted   string
+	}
+
+	noop := func(w io.Writer) error { return nil }
+
+	p := &Parent{
+		Name:   "parent",
+		Value:  producer.MustNewValue("$.Value", noop),
+		Quoted: `"quoted test"`,
+	}
+	for i := 0; i < 2; i++ {
+		p.Children = append(p.Children, &Child{
+			Name:   fmt.Sprintf("child%d", i),
+			Values: producer.MustNewValue(fmt.Sprintf("$.Child[%d].Values", i), noop),
+		})
+	}
+
+	doc, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the consumer resolves them differently.
+	r := reader.New(bytes.NewReader(doc))
+	r.MustHandle("$.Value", func(w io.Writer) error {
+		_, err := w.Write([]byte(`{"Hoge":"hoge1"}`))
+		return err
+	})
+	for i := 0; i < 2; i++ {
+		i := i
+		r.MustHandle(fmt.Sprintf("$.Child[%d].Values", i), func(w io.Writer) error {
+			_, err := fmt.Fprintf(w, "[%d,%d]", i, i+1)
+			return err
+		})
+	}
+	if err := r.Handle("$.Value", noop); err != writer.ErrDuplicateKey {
+		t.Fatalf("ErrDuplicateKey expected, but was %v", err)
+	}
+
+	resolved, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Name":"parent","Value":{"Hoge":"hoge1"},"Children":[{"Name":"child0","Values":[0,1]},{"Name":"child1","Values":[1,2]}],"Quoted":"\"quoted test\""}`
+	if actual := string(resolved); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestReadUnknownKey(t *testing.T) {
+	producer := writer.New(ioutil.Discard)
+
+	doc, err := json.Marshal(map[string]interface{}{
+		"value": producer.MustNewValue("unknown", func(w io.Writer) error { return nil }),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := reader.New(bytes.NewReader(doc))
+	defer r.Close()
+
+	if _, err := ioutil.ReadAll(r); !errors.Is(err, writer.ErrUnknownKey) {
+		t.Fatalf("ErrUnknownKey expected, but was %v", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	r := reader.New(bytes.NewReader([]byte(`[1,2,3]`)))
+
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Read(make([]byte, 1)); err != io.ErrClosedPipe {
+		t.Fatalf("io.ErrClosedPipe expected, but was %v", err)
+	}
+}
@@ -0,0 +1,521 @@
+package writer
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrBufferLimitExceeded is returned when buffered data exceeds the configured limit.
+var ErrBufferLimitExceeded = errors.New("buffer limit exceeded")
+
+// NewJSONLinesArrayValue creates a Value which describes JSON array converted from JSON Lines read from r.
+// Each non-blank line must be a valid JSON value, and r is read lazily when the value is streamed.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewJSONLinesArrayValue(key string, r io.Reader) (*Value, error) {
+	return w.newValue(key, jsonLinesArrayValueFunc(r))
+}
+
+// MustNewJSONLinesArrayValue creates a Value which describes JSON array converted from JSON Lines read from r.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewJSONLinesArrayValue(key string, r io.Reader) *Value {
+	return w.mustNewValue(key, jsonLinesArrayValueFunc(r))
+}
+
+func jsonLinesArrayValueFunc(r io.Reader) ArrayValueFunc {
+	return func(ew ElementWriter) error {
+		br := bufio.NewReader(r)
+		for n := 1; ; n++ {
+			line, err := br.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				if !json.Valid(line) {
+					return fmt.Errorf("invalid JSON at line %d", n)
+				}
+				if err := ew.WriteElement(json.RawMessage(line)); err != nil {
+					return err
+				}
+			}
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// NewNDJSONValue creates a Value which describes the elements written by f as newline-delimited JSON,
+// i.e. each element on its own line without the enclosing brackets, so that consumers can process them incrementally.
+// The result isn't a JSON value, so the Value must be encoded alone as the whole document, e.g. by Writer.Encode,
+// which terminates the last line. Elements written by WriteRawElement and WriteElementFunc must not contain newlines.
+// WithValidation validates each line as a JSON value, while WithPrettyValues, WithIndent and WithMinify
+// make the Value fail, since indenting would split the elements across lines and minifying would join them.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewNDJSONValue(key string, f ArrayValueFunc, opts ...ArrayOption) (*Value, error) {
+	return w.newValue(key, ndjsonValueFunc(f), arrayInits(opts)...)
+}
+
+// MustNewNDJSONValue creates a Value which describes the elements written by f as newline-delimited JSON.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewNDJSONValue(key string, f ArrayValueFunc, opts ...ArrayOption) *Value {
+	return w.mustNewValue(key, ndjsonValueFunc(f), arrayInits(opts)...)
+}
+
+// ndjsonValueFunc is ArrayValueFunc whose elements are written as newline-delimited JSON.
+type ndjsonValueFunc ArrayValueFunc
+
+// NewRawArrayValue creates a Value which describes JSON array of pre-encoded elements passed to emit by f,
+// e.g. the objects yielded by a cursor, without encoding them again.
+// Each element is written verbatim like ElementWriter.WriteRawElement.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewRawArrayValue(key string, f func(emit func(raw json.RawMessage) error) error) (*Value, error) {
+	return w.newValue(key, rawArrayValueFunc(f))
+}
+
+// MustNewRawArrayValue creates a Value which describes JSON array of pre-encoded elements passed to emit by f.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewRawArrayValue(key string, f func(emit func(raw json.RawMessage) error) error) *Value {
+	return w.mustNewValue(key, rawArrayValueFunc(f))
+}
+
+func rawArrayValueFunc(f func(emit func(raw json.RawMessage) error) error) ArrayValueFunc {
+	return func(ew ElementWriter) error {
+		return f(ew.WriteRawElement)
+	}
+}
+
+// NewScannerArrayValue creates a Value which describes JSON array of tokens scanned by sc.
+// Each token split by the split function of sc is converted to an element by parse.
+// The token passed to parse may be overwritten by the next scan, so parse must not retain it.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewScannerArrayValue(key string, sc *bufio.Scanner, parse func(token []byte) (interface{}, error)) (*Value, error) {
+	return w.newValue(key, scannerArrayValueFunc(sc, parse))
+}
+
+// MustNewScannerArrayValue creates a Value which describes JSON array of tokens scanned by sc.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewScannerArrayValue(key string, sc *bufio.Scanner, parse func(token []byte) (interface{}, error)) *Value {
+	return w.mustNewValue(key, scannerArrayValueFunc(sc, parse))
+}
+
+func scannerArrayValueFunc(sc *bufio.Scanner, parse func(token []byte) (interface{}, error)) ArrayValueFunc {
+	return func(ew ElementWriter) error {
+		for sc.Scan() {
+			e, err := parse(sc.Bytes())
+			if err != nil {
+				return err
+			}
+			if err := ew.WriteElement(e); err != nil {
+				return err
+			}
+		}
+		return sc.Err()
+	}
+}
+
+// NewReversedArrayValue creates a Value which describes JSON array whose elements written by f are in reverse order.
+// The whole array is buffered in memory until f returns,
+// so use WithMaxReverseBuffer to guard the memory usage.
+// The aggregator given by WithElementAggregator receives the elements in the written order, i.e. reversed,
+// as they were given to f.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewReversedArrayValue(key string, f ArrayValueFunc, opts ...ArrayOption) (*Value, error) {
+	return w.newValue(key, w.reversedArrayValueFunc(f), arrayInits(opts)...)
+}
+
+// MustNewReversedArrayValue creates a Value which describes JSON array whose elements written by f are in reverse order.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewReversedArrayValue(key string, f ArrayValueFunc, opts ...ArrayOption) *Value {
+	return w.mustNewValue(key, w.reversedArrayValueFunc(f), arrayInits(opts)...)
+}
+
+func (w *Writer) reversedArrayValueFunc(f ArrayValueFunc) ArrayValueFunc {
+	return func(ew ElementWriter) error {
+		ctx := w.ctx
+		var encoder func(e interface{}) ([]byte, error)
+		dst, ok := ew.(*elementWriter)
+		if ok {
+			ctx = dst.ctx
+			encoder = dst.encoder
+		}
+
+		// the elements are expanded into buf, and passed to the aggregator of ew in reverse order later.
+		buf := &limitedBuffer{limit: w.maxReverseBuffer}
+		src := w.newElementWriter(buffered(ctx), buf)
+		src.encoder = encoder
+		aggregated := map[int]interface{}{}
+		src.aggregator = func(e interface{}) {
+			aggregated[src.n-1] = e
+		}
+		if _, err := buf.Write([]byte("[")); err != nil {
+			return err
+		}
+		if err := f(src); err != nil {
+			return err
+		}
+		if _, err := buf.Write([]byte("]")); err != nil {
+			return err
+		}
+
+		var elems []json.RawMessage
+		if err := json.Unmarshal(buf.Bytes(), &elems); err != nil {
+			return err
+		}
+
+		for i := len(elems) - 1; i >= 0; i-- {
+			if !ok {
+				if err := ew.WriteRawElement(elems[i]); err != nil {
+					return err
+				}
+				continue
+			}
+
+			e, aggregate := aggregated[i]
+			j := dst.n
+			if err := dst.writeRendered(elems[i], e, aggregate); err != nil {
+				return elementError(j, err)
+			}
+		}
+		return nil
+	}
+}
+
+// limitedBuffer is a bytes.Buffer which refuses to grow beyond limit.
+// It is unlimited if limit is not positive.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	if lb.limit > 0 && lb.Len()+len(p) > lb.limit {
+		return 0, ErrBufferLimitExceeded
+	}
+	return lb.Buffer.Write(p)
+}
+
+// ElementIterator yields elements one by one, e.g. from a cursor of a datastore.
+// Next returns false as ok when there are no more elements.
+type ElementIterator interface {
+	Next() (e interface{}, ok bool, err error)
+}
+
+// ElementIteratorFunc is an adapter to use a function as ElementIterator.
+type ElementIteratorFunc func() (e interface{}, ok bool, err error)
+
+// Next calls f.
+func (f ElementIteratorFunc) Next() (interface{}, bool, error) {
+	return f()
+}
+
+// NewIteratorArrayValue creates a Value which describes JSON array of elements yielded by it.
+// Next is called repeatedly until it returns false as ok, and its error aborts the stream.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewIteratorArrayValue(key string, it ElementIterator) (*Value, error) {
+	return w.newValue(key, iteratorArrayValueFunc(it))
+}
+
+// MustNewIteratorArrayValue creates a Value which describes JSON array of elements yielded by it.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewIteratorArrayValue(key string, it ElementIterator) *Value {
+	return w.mustNewValue(key, iteratorArrayValueFunc(it))
+}
+
+func iteratorArrayValueFunc(it ElementIterator) ArrayValueFunc {
+	return func(ew ElementWriter) error {
+		for {
+			e, ok, err := it.Next()
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return nil
+			}
+			if err := ew.WriteElement(e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// NewMergedSortedArrayValue creates a Value which describes JSON array merged from sorted sources in sorted order.
+// Each source must yield elements sorted by less. Elements which are equal are written in the order of sources.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewMergedSortedArrayValue(key string, less func(a, b interface{}) bool, sources ...ElementIterator) (*Value, error) {
+	return w.newValue(key, mergedSortedArrayValueFunc(less, sources))
+}
+
+// MustNewMergedSortedArrayValue creates a Value which describes JSON array merged from sorted sources in sorted order.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewMergedSortedArrayValue(key string, less func(a, b interface{}) bool, sources ...ElementIterator) *Value {
+	return w.mustNewValue(key, mergedSortedArrayValueFunc(less, sources))
+}
+
+func mergedSortedArrayValueFunc(less func(a, b interface{}) bool, sources []ElementIterator) ArrayValueFunc {
+	return func(ew ElementWriter) error {
+		h := &mergeHeap{less: less}
+		for i, src := range sources {
+			e, ok, err := src.Next()
+			if err != nil {
+				return err
+			}
+			if ok {
+				h.items = append(h.items, mergeItem{e: e, src: i})
+			}
+		}
+		heap.Init(h)
+
+		for h.Len() > 0 {
+			item := h.items[0]
+			if err := ew.WriteElement(item.e); err != nil {
+				return err
+			}
+
+			e, ok, err := sources[item.src].Next()
+			if err != nil {
+				return err
+			}
+			if ok {
+				h.items[0].e = e
+				heap.Fix(h, 0)
+			} else {
+				heap.Pop(h)
+			}
+		}
+
+		return nil
+	}
+}
+
+type mergeItem struct {
+	e   interface{}
+	src int
+}
+
+// mergeHeap implements heap.Interface for k-way merge.
+type mergeHeap struct {
+	items []mergeItem
+	less  func(a, b interface{}) bool
+}
+
+func (h *mergeHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	if h.less(a.e, b.e) {
+		return true
+	}
+	if h.less(b.e, a.e) {
+		return false
+	}
+	return a.src < b.src
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *mergeHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(mergeItem))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+// DefaultRetryBackoff is the wait before each retry of RetryPolicy without Backoff.
+const DefaultRetryBackoff = 100 * time.Millisecond
+
+// RetryPolicy describes how to retry failed operations.
+type RetryPolicy struct {
+	// MaxRetries is the max number of retries. It doesn't retry if MaxRetries is 0.
+	MaxRetries int
+	// Backoff returns the wait before n-th retry, which starts from 1.
+	// It waits DefaultRetryBackoff before each retry if Backoff is nil.
+	Backoff func(n int) time.Duration
+	// Retryable reports whether err is transient. All errors are retried if Retryable is nil.
+	Retryable func(err error) bool
+}
+
+// NewPaginatedArrayValue creates a Value which describes JSON array of elements fetched page by page.
+// fetch is called with empty cursor for the first page, and returns elements with the cursor of the next page,
+// which is empty for the last page.
+// A failed fetch is retried according to retry. It is always safe,
+// because elements of a page are written only after the whole page is fetched.
+// The wait before a retry ends early when the value is no longer going to be written, e.g. the document has failed.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewPaginatedArrayValue(key string, fetch func(cursor string) ([]json.RawMessage, string, error), retry RetryPolicy) (*Value, error) {
+	return w.newValue(key, w.paginatedArrayValueFunc(fetch, retry))
+}
+
+// MustNewPaginatedArrayValue creates a Value which describes JSON array of elements fetched page by page.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewPaginatedArrayValue(key string, fetch func(cursor string) ([]json.RawMessage, string, error), retry RetryPolicy) *Value {
+	return w.mustNewValue(key, w.paginatedArrayValueFunc(fetch, retry))
+}
+
+func (w *Writer) paginatedArrayValueFunc(fetch func(cursor string) ([]json.RawMessage, string, error), retry RetryPolicy) ArrayValueFunc {
+	return func(ew ElementWriter) error {
+		ctx := w.ctx
+		if ew, ok := ew.(*elementWriter); ok {
+			ctx = ew.ctx
+		}
+
+		var cursor string
+		for {
+			var elems []json.RawMessage
+			var next string
+			err := retryWithPolicy(ctx, retry, func() error {
+				var err error
+				elems, next, err = fetch(cursor)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+
+			for _, e := range elems {
+				if err := ew.WriteElement(e); err != nil {
+					return err
+				}
+			}
+
+			if next == "" {
+				return nil
+			}
+			cursor = next
+		}
+	}
+}
+
+// retryWithPolicy calls f until it succeeds according to policy, waiting between the calls unless ctx is done.
+func retryWithPolicy(ctx context.Context, policy RetryPolicy, f func() error) error {
+	for n := 0; ; n++ {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		if n >= policy.MaxRetries || (policy.Retryable != nil && !policy.Retryable(err)) {
+			return err
+		}
+
+		d := DefaultRetryBackoff
+		if policy.Backoff != nil {
+			d = policy.Backoff(n + 1)
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// NewRingBufferArrayValue creates a Value which describes JSON array of string entries in a ring buffer in chronological order.
+// head is the index of the oldest entry, and entries are written from there wrapping around the end of ring.
+// ring is copied as a snapshot when the value is created, so the owner can keep writing to it.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewRingBufferArrayValue(key string, ring []string, head int) (*Value, error) {
+	return w.newValue(key, ringBufferArrayValueFunc(ring, head))
+}
+
+// MustNewRingBufferArrayValue creates a Value which describes JSON array of string entries in a ring buffer in chronological order.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewRingBufferArrayValue(key string, ring []string, head int) *Value {
+	return w.mustNewValue(key, ringBufferArrayValueFunc(ring, head))
+}
+
+func ringBufferArrayValueFunc(ring []string, head int) ArrayValueFunc {
+	snapshot := make([]string, 0, len(ring))
+	if len(ring) > 0 {
+		head %= len(ring)
+		if head < 0 {
+			head += len(ring)
+		}
+		snapshot = append(snapshot, ring[head:]...)
+		snapshot = append(snapshot, ring[:head]...)
+	}
+
+	return func(ew ElementWriter) error {
+		for _, e := range snapshot {
+			if err := ew.WriteElement(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// RowWriter writes rows of a columnar array.
+type RowWriter interface {
+	// WriteRow writes a row, whose values must be in the order of the columns.
+	WriteRow(values ...interface{}) error
+}
+
+// NewColumnarArrayValue creates a Value which describes JSON array in columnar form.
+// The first element is the array of columns, and each of following elements is the array of values of a row,
+// e.g. [["id","name"],[1,"a"],[2,"b"]], which saves repeating field names on every object.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewColumnarArrayValue(key string, columns []string, f func(rw RowWriter) error) (*Value, error) {
+	return w.newValue(key, columnarArrayValueFunc(columns, f))
+}
+
+// MustNewColumnarArrayValue creates a Value which describes JSON array in columnar form.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewColumnarArrayValue(key string, columns []string, f func(rw RowWriter) error) *Value {
+	return w.mustNewValue(key, columnarArrayValueFunc(columns, f))
+}
+
+func columnarArrayValueFunc(columns []string, f func(rw RowWriter) error) ArrayValueFunc {
+	return func(ew ElementWriter) error {
+		if err := ew.WriteElement(columns); err != nil {
+			return err
+		}
+		return f(&rowWriter{ew: ew, columns: len(columns)})
+	}
+}
+
+type rowWriter struct {
+	ew      ElementWriter
+	columns int
+}
+
+func (rw *rowWriter) WriteRow(values ...interface{}) error {
+	if len(values) != rw.columns {
+		return fmt.Errorf("row has %d values, but %d columns expected", len(values), rw.columns)
+	}
+	return rw.ew.WriteElement(values)
+}
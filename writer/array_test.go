@@ -0,0 +1,637 @@
+package writer_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+func TestJSONLinesArrayValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	jsonl := "{\"ID\":1,\"Name\":\"a\"}\n{\"ID\":2, \"Name\":\"b\"}\n\n{\"ID\":3,\"Name\":\"c\"}"
+
+	root := struct {
+		Rows *writer.Value
+	}{
+		Rows: w.MustNewJSONLinesArrayValue("rows", strings.NewReader(jsonl)),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Rows":[{"ID":1,"Name":"a"},{"ID":2,"Name":"b"},{"ID":3,"Name":"c"}]}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestJSONLinesArrayValueInvalidLine(t *testing.T) {
+	w := writer.New(new(bytes.Buffer))
+
+	root := struct {
+		Rows *writer.Value
+	}{
+		Rows: w.MustNewJSONLinesArrayValue("rows", strings.NewReader("{\"ID\":1}\n{\"ID\":")),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestNDJSONValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	type row struct {
+		ID    int
+		Child *writer.Value
+	}
+
+	child := w.MustNewValue("child", func(w io.Writer) error {
+		_, err := w.Write([]byte(`"child"`))
+		return err
+	})
+
+	var count int
+	v := w.MustNewNDJSONValue("rows", func(w writer.ElementWriter) error {
+		for i := 1; i <= 3; i++ {
+			if err := w.WriteElement(&row{ID: i, Child: child}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, writer.WithElementAggregator(func(e interface{}) {
+		count++
+	}))
+
+	if err := w.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"ID":1,"Child":"child"}` + "\n" + `{"ID":2,"Child":"child"}` + "\n" + `{"ID":3,"Child":"child"}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+
+	if count != 3 {
+		t.Fatalf("aggregated count expected 3, but was %d", count)
+	}
+
+	// each line is a JSON value.
+	dec := json.NewDecoder(strings.NewReader(expected))
+	for i := 1; dec.More(); i++ {
+		var r struct{ ID int }
+		if err := dec.Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		if r.ID != i {
+			t.Fatalf("ID expected %d, but was %d", i, r.ID)
+		}
+	}
+}
+
+func TestNDJSONValueOptions(t *testing.T) {
+	elements := func(w writer.ElementWriter) error {
+		for i := 1; i <= 3; i++ {
+			if err := w.WriteElement(map[string]int{"ID": i}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	t.Run("validation", func(t *testing.T) {
+		buf := new(bytes.Buffer)
+		w := writer.New(buf, writer.WithValidation())
+
+		if err := w.Encode(w.MustNewNDJSONValue("rows", elements)); err != nil {
+			t.Fatal(err)
+		}
+
+		expected := `{"ID":1}` + "\n" + `{"ID":2}` + "\n" + `{"ID":3}` + "\n"
+		if actual := buf.String(); actual != expected {
+			t.Fatalf("result expected:%s, but was %s", expected, actual)
+		}
+
+		// a malformed line is still rejected.
+		v := w.MustNewNDJSONValue("malformed", func(w writer.ElementWriter) error {
+			if err := w.WriteElement(1); err != nil {
+				return err
+			}
+			return w.WriteRawElement(json.RawMessage(`{"ID":`))
+		})
+		if err := w.Encode(v); err == nil || !strings.Contains(err.Error(), "invalid JSON") {
+			t.Fatalf("invalid JSON error expected, but was %v", err)
+		}
+	})
+
+	for name, opt := range map[string]writer.Option{
+		"pretty": writer.WithPrettyValues("  "),
+		"indent": writer.WithIndent("", "  "),
+		"minify": writer.WithMinify(true),
+	} {
+		t.Run(name, func(t *testing.T) {
+			buf := new(bytes.Buffer)
+			w := writer.New(buf, opt)
+
+			err := w.Encode(w.MustNewNDJSONValue("rows", elements))
+			if err == nil || !strings.Contains(err.Error(), "NDJSON value can't be") {
+				t.Fatalf("NDJSON error expected, but was %v", err)
+			}
+			if buf.Len() != 0 {
+				t.Fatalf("nothing expected to be written, but was %s", buf)
+			}
+		})
+	}
+}
+
+func TestRawArrayValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	rows := []string{`{"ID":1}`, `{"ID":2}`, `{"ID":3}`}
+
+	root := struct {
+		Rows  *writer.Value
+		Empty *writer.Value
+	}{
+		Rows: w.MustNewRawArrayValue("rows", func(emit func(raw json.RawMessage) error) error {
+			for _, row := range rows {
+				if err := emit(json.RawMessage(row)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+		Empty: w.MustNewRawArrayValue("empty", func(emit func(raw json.RawMessage) error) error {
+			return nil
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Rows":[{"ID":1},{"ID":2},{"ID":3}],"Empty":[]}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestReversedArrayValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	root := struct {
+		Newest *writer.Value
+	}{
+		Newest: w.MustNewReversedArrayValue("newest", func(w writer.ElementWriter) error {
+			for i := 1; i <= 3; i++ {
+				if err := w.WriteElement(i); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"Newest":[3,2,1]}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestReversedArrayValueExpanded(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	type item struct {
+		ID int
+	}
+	var aggregated []interface{}
+	nested := w.MustNewValue("nested", func(w io.Writer) error {
+		_, err := w.Write([]byte(`"nested"`))
+		return err
+	})
+	root := struct {
+		Newest *writer.Value
+	}{
+		Newest: w.MustNewReversedArrayValue("newest", func(w writer.ElementWriter) error {
+			if err := w.WriteElement(item{ID: 1}); err != nil {
+				return err
+			}
+			// written verbatim, and must not be expanded later even though it looks like a placeholder.
+			if err := w.WriteRawElement(json.RawMessage(`"` + writer.SentinelJSON() + `nested"`)); err != nil {
+				return err
+			}
+			return w.WriteElement(nested)
+		}, writer.WithElementAggregator(func(e interface{}) {
+			aggregated = append(aggregated, e)
+		})),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Newest":["nested","` + writer.SentinelJSON() + `nested",{"ID":1}]}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+
+	// the aggregator receives the elements as they were given, not the rendered ones.
+	expectedAggregated := []interface{}{nested, json.RawMessage(`"` + writer.SentinelJSON() + `nested"`), item{ID: 1}}
+	if !reflect.DeepEqual(aggregated, expectedAggregated) {
+		t.Fatalf("aggregated expected:%v, but was %v", expectedAggregated, aggregated)
+	}
+}
+
+func TestReversedArrayValueBufferLimit(t *testing.T) {
+	w := writer.New(new(bytes.Buffer), writer.WithMaxReverseBuffer(10))
+
+	root := struct {
+		Newest *writer.Value
+	}{
+		Newest: w.MustNewReversedArrayValue("newest", func(w writer.ElementWriter) error {
+			for i := 0; i < 3; i++ {
+				if err := w.WriteElement("abcd"); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); !errors.Is(err, writer.ErrBufferLimitExceeded) {
+		t.Fatalf("ErrBufferLimitExceeded expected, but was %v", err)
+	}
+}
+
+// sliceIterator returns an ElementIterator which yields es.
+func sliceIterator(es ...interface{}) writer.ElementIterator {
+	return writer.ElementIteratorFunc(func() (interface{}, bool, error) {
+		if len(es) == 0 {
+			return nil, false, nil
+		}
+		e := es[0]
+		es = es[1:]
+		return e, true, nil
+	})
+}
+
+func TestMergedSortedArrayValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	less := func(a, b interface{}) bool {
+		return a.(int) < b.(int)
+	}
+
+	root := struct {
+		Merged *writer.Value
+	}{
+		Merged: w.MustNewMergedSortedArrayValue("merged", less,
+			sliceIterator(1, 4, 5, 9),
+			sliceIterator(),
+			sliceIterator(2, 3, 5, 10, 11),
+		),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"Merged":[1,2,3,4,5,5,9,10,11]}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestPaginatedArrayValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	pages := map[string][]json.RawMessage{
+		"":  {json.RawMessage(`1`), json.RawMessage(`2`)},
+		"2": {json.RawMessage(`3`), json.RawMessage(`4`)},
+		"4": {json.RawMessage(`5`)},
+	}
+	nexts := map[string]string{"": "2", "2": "4", "4": ""}
+
+	errTransient := errors.New("transient")
+	var failed bool
+	var cursors []string
+	fetch := func(cursor string) ([]json.RawMessage, string, error) {
+		cursors = append(cursors, cursor)
+		if cursor == "2" && !failed {
+			failed = true
+			return nil, "", errTransient
+		}
+		return pages[cursor], nexts[cursor], nil
+	}
+
+	var backoffs []int
+	retry := writer.RetryPolicy{
+		MaxRetries: 2,
+		Backoff: func(n int) time.Duration {
+			backoffs = append(backoffs, n)
+			return time.Millisecond
+		},
+		Retryable: func(err error) bool {
+			return errors.Is(err, errTransient)
+		},
+	}
+
+	root := struct {
+		Items *writer.Value
+	}{
+		Items: w.MustNewPaginatedArrayValue("items", fetch, retry),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"Items":[1,2,3,4,5]}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+	if expected, actual := `["","2","2","4"]`, mustMarshal(t, cursors); actual != expected {
+		t.Errorf("cursors expected:%s, but was %s", expected, actual)
+	}
+	if expected, actual := `[1]`, mustMarshal(t, backoffs); actual != expected {
+		t.Errorf("backoffs expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestPaginatedArrayValueNotRetryable(t *testing.T) {
+	w := writer.New(new(bytes.Buffer))
+
+	errPermanent := errors.New("permanent")
+	var calls int
+	fetch := func(cursor string) ([]json.RawMessage, string, error) {
+		calls++
+		return nil, "", errPermanent
+	}
+
+	root := struct {
+		Items *writer.Value
+	}{
+		Items: w.MustNewPaginatedArrayValue("items", fetch, writer.RetryPolicy{
+			MaxRetries: 3,
+			Retryable: func(err error) bool {
+				return false
+			},
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); !errors.Is(err, errPermanent) {
+		t.Fatalf("%v expected, but was %v", errPermanent, err)
+	}
+	if calls != 1 {
+		t.Errorf("calls expected:1, but was %d", calls)
+	}
+}
+
+func TestPaginatedArrayValueDefaultBackoff(t *testing.T) {
+	w := writer.New(new(bytes.Buffer))
+
+	var calls []time.Time
+	fetch := func(cursor string) ([]json.RawMessage, string, error) {
+		calls = append(calls, time.Now())
+		if len(calls) == 1 {
+			return nil, "", errors.New("transient")
+		}
+		return []json.RawMessage{json.RawMessage(`1`)}, "", nil
+	}
+
+	if err := w.Encode(w.MustNewPaginatedArrayValue("items", fetch, writer.RetryPolicy{MaxRetries: 1})); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(calls) != 2 {
+		t.Fatalf("calls expected:2, but was %d", len(calls))
+	}
+	if d := calls[1].Sub(calls[0]); d < writer.DefaultRetryBackoff {
+		t.Errorf("retry expected to wait %v, but was %v", writer.DefaultRetryBackoff, d)
+	}
+}
+
+func TestPaginatedArrayValueCanceled(t *testing.T) {
+	w := writer.New(io.Discard, writer.WithConcurrency(1))
+
+	started := make(chan struct{})
+	canceled := make(chan error, 1)
+	w.MustNewArrayValue("unreached", func(ew writer.ElementWriter) error {
+		// created while prefetching, so that it is rendered with the context of the prefetch.
+		items := w.MustNewPaginatedArrayValue("items", func(cursor string) ([]json.RawMessage, string, error) {
+			close(started)
+			return nil, "", errors.New("transient")
+		}, writer.RetryPolicy{
+			MaxRetries: 1,
+			Backoff: func(n int) time.Duration {
+				return time.Hour
+			},
+		})
+
+		err := ew.WriteElement(items)
+		canceled <- err
+		return err
+	})
+	failing := w.MustNewValue("failing", func(w io.Writer) error {
+		<-started
+		return errors.New("failed")
+	})
+
+	if err := w.Encode(failing); err == nil {
+		t.Fatal("error expected")
+	}
+
+	select {
+	case err := <-canceled:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("context.Canceled expected, but was %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("retry outlives the failed document")
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) string {
+	t.Helper()
+
+	jsn, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(jsn)
+}
+
+func TestRingBufferArrayValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	// "line1" and "line2" have been overwritten by "line5" and "line6".
+	ring := []string{"line5", "line6", "line3", "line4"}
+
+	root := struct {
+		Logs  *writer.Value
+		Empty *writer.Value
+	}{
+		Logs:  w.MustNewRingBufferArrayValue("logs", ring, 2),
+		Empty: w.MustNewRingBufferArrayValue("empty", nil, 0),
+	}
+
+	// later writes to the ring don't affect the snapshot.
+	ring[2] = "line7"
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"Logs":["line3","line4","line5","line6"],"Empty":[]}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestColumnarArrayValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	root := struct {
+		Rows *writer.Value
+	}{
+		Rows: w.MustNewColumnarArrayValue("rows", []string{"id", "name", "active"}, func(rw writer.RowWriter) error {
+			if err := rw.WriteRow(1, "alice", true); err != nil {
+				return err
+			}
+			return rw.WriteRow(2, "bob", false)
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Rows":[["id","name","active"],[1,"alice",true],[2,"bob",false]]}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestColumnarArrayValueColumnMismatch(t *testing.T) {
+	w := writer.New(new(bytes.Buffer))
+
+	root := struct {
+		Rows *writer.Value
+	}{
+		Rows: w.MustNewColumnarArrayValue("rows", []string{"id", "name"}, func(rw writer.RowWriter) error {
+			return rw.WriteRow(1)
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestScannerArrayValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	sc := bufio.NewScanner(strings.NewReader("the quick  brown\n\"fox\""))
+	sc.Split(bufio.ScanWords)
+
+	root := struct {
+		Words *writer.Value
+	}{
+		Words: w.MustNewScannerArrayValue("words", sc, func(token []byte) (interface{}, error) {
+			return string(token), nil
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"Words":["the","quick","brown","\"fox\""]}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+// fakeCursor is a cursor of a datastore which fails after items if err is set.
+type fakeCursor struct {
+	items []interface{}
+	err   error
+}
+
+func (c *fakeCursor) Next() (interface{}, bool, error) {
+	if len(c.items) == 0 {
+		if c.err != nil {
+			return nil, false, c.err
+		}
+		return nil, false, nil
+	}
+	item := c.items[0]
+	c.items = c.items[1:]
+	return item, true, nil
+}
+
+func TestIteratorArrayValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	type Entity struct {
+		ID int
+	}
+
+	root := struct {
+		Entities *writer.Value
+	}{
+		Entities: w.MustNewIteratorArrayValue("entities", &fakeCursor{
+			items: []interface{}{&Entity{ID: 1}, &Entity{ID: 2}, &Entity{ID: 3}},
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"Entities":[{"ID":1},{"ID":2},{"ID":3}]}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestIteratorArrayValueError(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	errCursor := errors.New("cursor expired")
+
+	root := struct {
+		Entities *writer.Value
+	}{
+		Entities: w.MustNewIteratorArrayValue("entities", &fakeCursor{
+			items: []interface{}{1},
+			err:   errCursor,
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); !errors.Is(err, errCursor) {
+		t.Fatalf("%v expected, but was %v", errCursor, err)
+	}
+}
@@ -0,0 +1,47 @@
+package writer
+
+import "io"
+
+// CircuitBreaker decides whether callbacks of guarded values may be called.
+// It is typically shared among Writers to protect an unreliable upstream.
+type CircuitBreaker interface {
+	// Allow reports whether the callback may be called.
+	Allow() bool
+	// Record records the result of the callback.
+	Record(err error)
+}
+
+// NewGuardedValue creates a Value guarded by the CircuitBreaker of group given by WithCircuitBreaker.
+// When the breaker doesn't allow, null is written without calling f.
+// Otherwise f is called and its result is recorded to the breaker, and its error is returned as usual.
+// f is called without guard if no breaker is given for group.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewGuardedValue(key string, group string, f ValueFunc) (*Value, error) {
+	return w.newValue(key, w.guardedValueFunc(group, f))
+}
+
+// MustNewGuardedValue creates a Value guarded by the CircuitBreaker of group given by WithCircuitBreaker.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewGuardedValue(key string, group string, f ValueFunc) *Value {
+	return w.mustNewValue(key, w.guardedValueFunc(group, f))
+}
+
+func (w *Writer) guardedValueFunc(group string, f ValueFunc) ValueFunc {
+	return func(out io.Writer) error {
+		cb, ok := w.breakers[group]
+		if !ok {
+			return f(out)
+		}
+
+		if !cb.Allow() {
+			_, err := out.Write([]byte("null"))
+			return err
+		}
+
+		err := f(out)
+		cb.Record(err)
+		return err
+	}
+}
@@ -0,0 +1,92 @@
+package writer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+// countingBreaker opens after threshold consecutive failures.
+type countingBreaker struct {
+	threshold int
+	failures  int
+}
+
+func (cb *countingBreaker) Allow() bool {
+	return cb.failures < cb.threshold
+}
+
+func (cb *countingBreaker) Record(err error) {
+	if err != nil {
+		cb.failures++
+	} else {
+		cb.failures = 0
+	}
+}
+
+func TestGuardedValue(t *testing.T) {
+	cb := &countingBreaker{threshold: 2}
+	errUpstream := errors.New("upstream unavailable")
+
+	var calls int
+	encode := func() (string, error) {
+		buf := new(bytes.Buffer)
+		w := writer.New(buf, writer.WithCircuitBreaker("upstream", cb))
+
+		root := struct {
+			Data *writer.Value
+		}{
+			Data: w.MustNewGuardedValue("data", "upstream", func(w io.Writer) error {
+				calls++
+				return errUpstream
+			}),
+		}
+
+		err := json.NewEncoder(w).Encode(&root)
+		return buf.String(), err
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := encode(); !errors.Is(err, errUpstream) {
+			t.Fatalf("%v expected, but was %v", errUpstream, err)
+		}
+	}
+
+	// the breaker is open now.
+	result, err := encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{"Data":null}` + "\n"; result != expected {
+		t.Errorf("result expected:%s, but was %s", expected, result)
+	}
+	if expected := 2; calls != expected {
+		t.Errorf("calls expected:%d, but was %d", expected, calls)
+	}
+}
+
+func TestGuardedValueWithoutBreaker(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	root := struct {
+		Data *writer.Value
+	}{
+		Data: w.MustNewGuardedValue("data", "unknown", func(w io.Writer) error {
+			_, err := w.Write([]byte("1"))
+			return err
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"Data":1}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
@@ -0,0 +1,47 @@
+package writer
+
+import (
+	"bytes"
+	"io"
+)
+
+// Cache stores rendered values by key.
+type Cache interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, value []byte)
+}
+
+// NewCachedValue creates a Value which is read through cache by cacheKey.
+// On hit, the cached bytes are written without calling f.
+// On miss, the output of f is buffered, stored to cache and written. Nothing is stored if f returns error.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewCachedValue(key string, cache Cache, cacheKey string, f ValueFunc) (*Value, error) {
+	return w.newValue(key, cachedValueFunc(cache, cacheKey, f))
+}
+
+// MustNewCachedValue creates a Value which is read through cache by cacheKey.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewCachedValue(key string, cache Cache, cacheKey string, f ValueFunc) *Value {
+	return w.mustNewValue(key, cachedValueFunc(cache, cacheKey, f))
+}
+
+func cachedValueFunc(cache Cache, cacheKey string, f ValueFunc) ValueFunc {
+	return func(w io.Writer) error {
+		if b, ok := cache.Get(cacheKey); ok {
+			_, err := w.Write(b)
+			return err
+		}
+
+		var buf bytes.Buffer
+		if err := f(&flushWriter{&buf}); err != nil {
+			return err
+		}
+
+		cache.Set(cacheKey, buf.Bytes())
+
+		_, err := w.Write(buf.Bytes())
+		return err
+	}
+}
@@ -0,0 +1,68 @@
+package writer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+type mapCache map[string][]byte
+
+func (c mapCache) Get(key string) ([]byte, bool) {
+	b, ok := c[key]
+	return b, ok
+}
+
+func (c mapCache) Set(key string, value []byte) {
+	c[key] = value
+}
+
+func TestCachedValue(t *testing.T) {
+	cache := mapCache{}
+
+	var calls int
+	encode := func() string {
+		buf := new(bytes.Buffer)
+		w := writer.New(buf)
+
+		root := struct {
+			Report *writer.Value
+		}{
+			Report: w.MustNewCachedValue("report", cache, "report:2021", func(w io.Writer) error {
+				calls++
+				f, ok := w.(writer.Flusher)
+				if !ok {
+					return fmt.Errorf("%T is not a Flusher", w)
+				}
+				if _, err := w.Write([]byte(`{"total":100}`)); err != nil {
+					return err
+				}
+				return f.Flush()
+			}),
+		}
+
+		if err := json.NewEncoder(w).Encode(&root); err != nil {
+			t.Fatal(err)
+		}
+
+		return buf.String()
+	}
+
+	expected := `{"Report":{"total":100}}` + "\n"
+	for i := 0; i < 2; i++ {
+		if actual := encode(); actual != expected {
+			t.Fatalf("result expected:%s, but was %s", expected, actual)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("callback must be called only once, but was %d", calls)
+	}
+	if _, ok := cache.Get("report:2021"); !ok {
+		t.Error("value must be cached")
+	}
+}
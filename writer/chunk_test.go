@@ -0,0 +1,182 @@
+package writer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+// stringPieces are pieces of random strings, which are likely to be confused with escapes or the sentinel.
+var stringPieces = []string{
+	"a", " ", `"`, `\`, `\\`, `\"`, "🎏", `\🎏`, `\\🎏`, "\n", "\t", " ", "<&>", "日本語", "\x01",
+}
+
+func randomString(r *rand.Rand) string {
+	var s string
+	for i := r.Intn(6); i > 0; i-- {
+		s += stringPieces[r.Intn(len(stringPieces))]
+	}
+	// strings starting with the sentinel are restricted.
+	if strings.HasPrefix(s, writer.Sentinel()) {
+		s = "a" + s
+	}
+	return s
+}
+
+// randomDocument builds a random document in which values are placeholders or ordinary values.
+func randomDocument(r *rand.Rand, w *writer.Writer, depth int, seq *int) interface{} {
+	switch n := r.Intn(7); {
+	case n == 0 && depth < 3:
+		m := map[string]interface{}{}
+		for i := r.Intn(4); i > 0; i-- {
+			m[randomString(r)] = randomDocument(r, w, depth+1, seq)
+		}
+		return m
+	case n == 1 && depth < 3:
+		var a []interface{}
+		for i := r.Intn(4); i > 0; i-- {
+			a = append(a, randomDocument(r, w, depth+1, seq))
+		}
+		return a
+	case n == 2:
+		*seq++
+		key := fmt.Sprintf("%s%d", randomString(r), *seq)
+		content := randomString(r)
+		return w.MustNewValue(key, func(w io.Writer) error {
+			jsn, err := json.Marshal(map[string]string{"key": key, "content": content})
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(jsn)
+			return err
+		})
+	case n == 3:
+		return r.Float64()
+	case n == 4:
+		return r.Intn(2) == 0
+	default:
+		return randomString(r)
+	}
+}
+
+// writeChunked writes p to w in random chunks.
+func writeChunked(r *rand.Rand, w io.Writer, p []byte) error {
+	for len(p) > 0 {
+		n := r.Intn(len(p)) + 1
+		if r.Intn(2) == 0 {
+			// small chunks are more likely to split escapes and the sentinel.
+			n = r.Intn(3) + 1
+			if n > len(p) {
+				n = len(p)
+			}
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			return err
+		}
+		p = p[n:]
+	}
+	return nil
+}
+
+func TestWriteChunkingIndependent(t *testing.T) {
+	f := func(seed int64) bool {
+		r := rand.New(rand.NewSource(seed))
+
+		expected := new(bytes.Buffer)
+		we := writer.New(expected)
+		actual := new(bytes.Buffer)
+		wa := writer.New(actual)
+
+		// the same document is built for both writers from the same seed.
+		var seq int
+		doc := randomDocument(rand.New(rand.NewSource(seed)), we, 0, &seq)
+		seq = 0
+		_ = randomDocument(rand.New(rand.NewSource(seed)), wa, 0, &seq)
+
+		encoded, err := json.Marshal(doc)
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+
+		if _, err := we.Write(encoded); err != nil {
+			t.Error(err)
+			return false
+		}
+		if err := writeChunked(r, wa, encoded); err != nil {
+			t.Error(err)
+			return false
+		}
+
+		if actual.String() != expected.String() {
+			t.Errorf("seed %d: chunked output differs\nexpected:%s\nactual:  %s", seed, expected, actual)
+			return false
+		}
+
+		if !json.Valid(expected.Bytes()) {
+			t.Errorf("seed %d: invalid output: %s", seed, expected)
+			return false
+		}
+
+		return true
+	}
+
+	if err := quick.Check(f, &quick.Config{MaxCount: 2000}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// oneByteWriter writes to w one byte at a time.
+type oneByteWriter struct {
+	w io.Writer
+}
+
+func (obw *oneByteWriter) Write(p []byte) (n int, err error) {
+	for i := range p {
+		if _, err := obw.w.Write(p[i : i+1]); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func TestWriteByteByByte(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	root := struct {
+		Value   *writer.Value
+		Short   []string
+		Similar []string
+		Array   *writer.Value
+	}{
+		Value: w.MustNewValue("value", func(w io.Writer) error {
+			_, err := w.Write([]byte(`{"a":"\\🎏"}`))
+			return err
+		}),
+		// shorter than the prefix, which are determined at the end of the strings.
+		Short: []string{"", `\`, `\\`, `"`, "🎏"},
+		// diverge from the prefix at the last byte.
+		Similar: []string{`\🎐`, `\\🎏`, `/🎏`},
+		Array: w.MustNewArrayValue("array", func(w writer.ElementWriter) error {
+			return w.WriteElement("a")
+		}),
+	}
+
+	if err := json.NewEncoder(&oneByteWriter{w: w}).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Value":{"a":"\\🎏"},"Short":["","\\","\\\\","\"","🎏"],"Similar":["\\🎐","\\\\🎏","/🎏"],"Array":["a"]}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
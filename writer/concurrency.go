@@ -0,0 +1,138 @@
+package writer
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// prefetch is a value rendered concurrently before its placeholder is reached.
+type prefetch struct {
+	v        *Value
+	claimed  bool // guarded by the Writer's lock
+	skipped  bool // the value was canceled before it was claimed
+	done     chan struct{}
+	buf      bytes.Buffer
+	err      error
+	deferred []func() // the bookkeeping of the nested values, done when buf is written out
+}
+
+// startPrefetches renders the registered values with w.concurrency workers.
+// The workers stop taking values when the document fails or the Writer is reset.
+func (w *Writer) startPrefetches() {
+	w.lock()
+	defer w.unlock()
+
+	if w.prefetches != nil {
+		return
+	}
+
+	w.prefetchCtx, w.cancelPrefetches = context.WithCancel(w.ctx)
+	w.prefetches = map[string]*prefetch{}
+	queue := make(chan *prefetch, len(w.m))
+	for key, v := range w.m {
+		if v.canceled {
+			continue
+		}
+		p := &prefetch{v: v, done: make(chan struct{})}
+		w.prefetches[key] = p
+		queue <- p
+	}
+	close(queue)
+
+	n := w.concurrency
+	if n > len(queue) {
+		n = len(queue)
+	}
+	ctx := w.prefetchCtx
+	for i := 0; i < n; i++ {
+		go func() {
+			for p := range queue {
+				if ctx.Err() != nil {
+					return
+				}
+				w.runPrefetch(ctx, p)
+			}
+		}()
+	}
+}
+
+// runPrefetch renders p into its buffer unless another goroutine has claimed it.
+func (w *Writer) runPrefetch(ctx context.Context, p *prefetch) {
+	w.lock()
+	claimed := p.claimed
+	if !claimed {
+		p.claimed = true
+		p.skipped = p.v.canceled
+	}
+	w.unlock()
+	if claimed {
+		return
+	}
+
+	defer close(p.done)
+	if p.skipped {
+		// the callback of a canceled value must not run.
+		return
+	}
+	ctx = context.WithValue(buffered(ctx), prefetchKey{}, p)
+	p.err = w.expandValue(ctx, &p.buf, p.v)
+}
+
+type prefetchKey struct{}
+
+// record does f, which updates the states of the Writer for a value written to the output, e.g. UnusedKeys.
+// In a prefetch, f is deferred until the prefetched buffer is written out.
+func record(ctx context.Context, f func()) {
+	if p, ok := ctx.Value(prefetchKey{}).(*prefetch); ok {
+		p.deferred = append(p.deferred, f)
+		return
+	}
+	f()
+}
+
+// stopPrefetches cancels the prefetches whose placeholders are no longer going to be reached.
+// It must be called with the lock held.
+func (w *Writer) stopPrefetches() {
+	if w.cancelPrefetches != nil {
+		w.cancelPrefetches()
+	}
+	w.prefetches = nil
+	w.prefetchCtx = nil
+	w.cancelPrefetches = nil
+}
+
+// writePrefetched writes the prefetched value of key to out, and returns false if it's not prefetched.
+// A value no worker has taken yet is rendered by the calling goroutine instead of waiting for a worker,
+// so that a value nested in another prefetched value doesn't wait for the worker rendering its parent.
+// Waiting for a claimed value never deadlocks, since the goroutine which claimed it is already rendering it.
+func (w *Writer) writePrefetched(ctx context.Context, out io.Writer, key string) (bool, error) {
+	w.lock()
+	p, ok := w.prefetches[key]
+	pctx := w.prefetchCtx
+	w.unlock()
+	if !ok {
+		return false, nil
+	}
+
+	w.runPrefetch(pctx, p)
+
+	select {
+	case <-p.done:
+	case <-ctx.Done():
+		return true, ctx.Err()
+	}
+	if p.skipped {
+		return false, nil
+	}
+	if p.err != nil {
+		return true, p.err
+	}
+	if _, err := out.Write(p.buf.Bytes()); err != nil {
+		return true, err
+	}
+	for _, f := range p.deferred {
+		record(ctx, f)
+	}
+	return true, nil
+}
@@ -0,0 +1,244 @@
+package writer_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+func TestWithConcurrency(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithConcurrency(3))
+
+	// every callback waits until all of them have started, which never happens if they run sequentially.
+	var started sync.WaitGroup
+	started.Add(3)
+	all := make(chan struct{})
+	go func() {
+		started.Wait()
+		close(all)
+	}()
+
+	f := func(n int) writer.ValueFunc {
+		return func(w io.Writer) error {
+			started.Done()
+			select {
+			case <-all:
+			case <-time.After(5 * time.Second):
+				return fmt.Errorf("callbacks are not run concurrently")
+			}
+			_, err := fmt.Fprint(w, n)
+			return err
+		}
+	}
+
+	root := struct {
+		A, B *writer.Value
+		C    []*writer.Value
+	}{
+		A: w.MustNewValue("a", f(1)),
+		B: w.MustNewValue("b", f(2)),
+		C: []*writer.Value{
+			w.MustNewArrayValue("c", func(ew writer.ElementWriter) error {
+				started.Done()
+				<-all
+				return ew.WriteElement(3)
+			}),
+		},
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"A":1,"B":2,"C":[[3]]}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestConcurrentUse(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	canceled := w.MustNewValue("canceled", func(w io.Writer) error {
+		_, err := w.Write([]byte(`"not canceled"`))
+		return err
+	})
+
+	// other goroutines register and cancel values while the document is written.
+	var wg sync.WaitGroup
+	release := make(chan struct{})
+	slow := w.MustNewValue("slow", func(w io.Writer) error {
+		close(release)
+		wg.Wait()
+		_, err := w.Write([]byte(`"slow"`))
+		return err
+	})
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-release
+			w.MustNewValue(fmt.Sprintf("v%d", i), func(w io.Writer) error { return nil })
+			_ = w.UnusedKeys()
+			canceled.Cancel()
+		}(i)
+	}
+
+	if err := json.NewEncoder(w).Encode([]*writer.Value{slow, canceled}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `["slow",null]` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+
+	if keys := w.UnusedKeys(); len(keys) != 10 {
+		t.Fatalf("10 unused keys expected, but was %v", keys)
+	}
+}
+
+func TestWithConcurrencyNested(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithConcurrency(1))
+
+	inner := w.MustNewValue("inner", func(w io.Writer) error {
+		_, err := fmt.Fprint(w, 1)
+		return err
+	})
+	outer := w.MustNewArrayValue("outer", func(ew writer.ElementWriter) error {
+		return ew.WriteElement(map[string]interface{}{"x": inner})
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Encode(outer)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a value nested in a prefetched value deadlocks")
+	}
+
+	if expected, actual := `[{"x":1}]`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWithConcurrencyCancel(t *testing.T) {
+	w := writer.New(io.Discard, writer.WithConcurrency(2))
+
+	started := make(chan struct{})
+	canceled := make(chan struct{})
+	w.MustNewValueCtx("unreached", func(ctx context.Context, w io.Writer) error {
+		close(started)
+		<-ctx.Done()
+		close(canceled)
+		return ctx.Err()
+	})
+	failing := w.MustNewValue("failing", func(w io.Writer) error {
+		<-started
+		return fmt.Errorf("failed")
+	})
+
+	if err := w.Encode(failing); err == nil {
+		t.Fatal("error expected")
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("prefetches outlive the failed document")
+	}
+}
+
+func TestWithConcurrencyCanceledLater(t *testing.T) {
+	w := writer.New(io.Discard, writer.WithConcurrency(1))
+
+	var mu sync.Mutex
+	var calls int
+	var vs []*writer.Value
+	for i := 0; i < 10; i++ {
+		vs = append(vs, w.MustNewValue(fmt.Sprintf("v%d", i), func(w io.Writer) error {
+			mu.Lock()
+			calls++
+			first := calls == 1
+			mu.Unlock()
+
+			// the first callback cancels the others, which are queued already.
+			if first {
+				for _, v := range vs {
+					v.Cancel()
+				}
+			}
+			return nil
+		}))
+	}
+
+	if err := w.Encode([]int{}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Fatalf("the callbacks of canceled values must not run, but %d ran", calls)
+	}
+}
+
+func TestWithConcurrencyNestedUnwritten(t *testing.T) {
+	var audited []string
+	var mu sync.Mutex
+	w := writer.New(io.Discard, writer.WithConcurrency(1), writer.WithAuditLogger(func(key string) {
+		mu.Lock()
+		defer mu.Unlock()
+		audited = append(audited, key)
+	}))
+
+	rendered := make(chan struct{})
+	inner := w.MustNewValue("inner", func(w io.Writer) error {
+		defer close(rendered)
+		_, err := fmt.Fprint(w, 1)
+		return err
+	})
+	w.MustNewArrayValue("outer", func(ew writer.ElementWriter) error {
+		return ew.WriteElement(map[string]interface{}{"x": inner})
+	})
+
+	// neither of the placeholders is reached.
+	if err := w.Encode([]int{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-rendered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("inner is not prefetched")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if expected, actual := "[inner outer]", fmt.Sprint(w.UnusedKeys()); actual != expected {
+		t.Errorf("unused keys expected:%s, but was %s", expected, actual)
+	}
+	if n := len(w.BytesByKey()); n != 0 {
+		t.Errorf("no bytes expected, but was %v", w.BytesByKey())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(audited) != 0 {
+		t.Errorf("no audit expected, but was %v", audited)
+	}
+}
@@ -0,0 +1,55 @@
+package writer
+
+import "context"
+
+// Drain flushes the destination at a safe boundary, so that in-flight responses can be completed cleanly,
+// e.g. on server shutdown.
+// If Write is in progress, it waits until the output reaches a safe boundary,
+// which is the end of an array element, a streamed value or a Write call.
+// Otherwise it flushes immediately.
+// ctx.Err() is returned if ctx is done before reaching a boundary.
+func (w *Writer) Drain(ctx context.Context) error {
+	w.lock()
+	if !w.writing {
+		defer w.unlock()
+		return flush(w.w)
+	}
+
+	ch := make(chan error, 1)
+	w.drains = append(w.drains, ch)
+	if w.rateLimit != nil {
+		// stop throttling until the boundary.
+		select {
+		case w.rateLimit.drain <- struct{}{}:
+		default:
+		}
+	}
+	w.unlock()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// safeBoundary is called when the output reaches a safe boundary, and serves pending Drain calls.
+func (w *Writer) safeBoundary() {
+	w.lock()
+	defer w.unlock()
+
+	if len(w.drains) == 0 {
+		return
+	}
+
+	if w.rateLimit != nil {
+		w.rateLimit.boundary()
+	}
+
+	err := flush(w.w)
+	for _, ch := range w.drains {
+		ch <- err
+	}
+	w.drains = nil
+}
@@ -0,0 +1,113 @@
+package writer_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+func TestDrain(t *testing.T) {
+	out := new(flushRecorder)
+	w := writer.New(out)
+
+	drained := make(chan error, 1)
+
+	root := struct {
+		Items *writer.Value
+	}{
+		Items: w.MustNewArrayValue("items", func(ew writer.ElementWriter) error {
+			if err := ew.WriteElement(1); err != nil {
+				return err
+			}
+
+			// shutdown begins in the middle of the element.
+			go func() {
+				drained <- w.Drain(context.Background())
+			}()
+			for writer.PendingDrains(w) == 0 {
+				time.Sleep(time.Millisecond)
+			}
+
+			if err := ew.WriteElement(2); err != nil {
+				return err
+			}
+
+			select {
+			case err := <-drained:
+				if err != nil {
+					return err
+				}
+			case <-time.After(time.Second):
+				t.Error("Drain must return at the end of the element")
+			}
+
+			return ew.WriteElement(3)
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := 1, len(out.flushed); actual != expected {
+		t.Fatalf("flush count expected:%d, but was %d", expected, actual)
+	}
+	if expected, actual := `{"Items":[1,2`, out.flushed[0]; actual != expected {
+		t.Errorf("flushed expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestDrainIdle(t *testing.T) {
+	out := new(flushRecorder)
+	w := writer.New(out)
+
+	if err := w.Drain(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := 1, len(out.flushed); actual != expected {
+		t.Fatalf("flush count expected:%d, but was %d", expected, actual)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	w := writer.New(new(flushRecorder))
+
+	done := make(chan struct{})
+	root := struct {
+		Value *writer.Value
+	}{
+		Value: w.MustNewArrayValue("value", func(ew writer.ElementWriter) error {
+			<-done
+			return nil
+		}),
+	}
+
+	encoded := make(chan error, 1)
+	go func() {
+		encoded <- json.NewEncoder(w).Encode(&root)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// wait until the encoding gets stuck.
+	for {
+		err := w.Drain(ctx)
+		if err == context.DeadlineExceeded {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(done)
+	if err := <-encoded; err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,325 @@
+package writer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// expander detects placeholders in JSON written to it, and writes it to out expanding the placeholders.
+type expander struct {
+	w   *Writer
+	ctx context.Context
+	out io.Writer
+
+	// only the placeholders of the children created by Sub are expanded, and the others are written verbatim.
+	scoped bool
+
+	// states
+	s           scanner // tracks the structure to tell object keys from values
+	onString    bool
+	escaping    bool
+	streamState streamState
+	stringBuf   *bytes.Buffer // taken from stringBufPool while a string in value position is undetermined or a placeholder
+
+	buf []byte // the output not written to out yet
+}
+
+// expanderBufferSize is the size of the buffer of expander.
+const expanderBufferSize = 4 * 1024
+
+func (w *Writer) newExpander(ctx context.Context, out io.Writer) *expander {
+	return &expander{w: w, ctx: ctx, out: out}
+}
+
+// Write processes p, and returns the number of bytes consumed from p,
+// which doesn't count the bytes of the expanded values written to out.
+// The output is coalesced in the buffer, which is flushed to out before each expanded value and at the end,
+// so that small writes don't reach out, e.g. compressing writers.
+func (x *expander) Write(p []byte) (n int, err error) {
+	start := 0 // the start of the pass-through bytes not written yet
+	for i, b := range p {
+		if x.passThrough(b) {
+			_ = x.s.step(b)
+			continue
+		}
+
+		if start < i {
+			if err := x.emit(p[start:i]); err != nil {
+				return start, err
+			}
+		}
+		start = i + 1
+
+		if err := x.step(b); err != nil {
+			_ = x.flush()
+			return i, err
+		}
+	}
+
+	if start < len(p) {
+		if err := x.emit(p[start:]); err != nil {
+			return start, err
+		}
+	}
+
+	unwritten := len(x.buf)
+	if err := x.flush(); err != nil {
+		if unwritten > len(p) {
+			return 0, err
+		}
+		return len(p) - unwritten, err
+	}
+
+	return len(p), nil
+}
+
+// emit writes p to out through the buffer.
+func (x *expander) emit(p []byte) error {
+	if len(x.buf)+len(p) > expanderBufferSize {
+		if err := x.flush(); err != nil {
+			return err
+		}
+		if len(p) > expanderBufferSize {
+			// too large to be worth copying.
+			_, err := x.out.Write(p)
+			return err
+		}
+	}
+
+	x.buf = append(x.buf, p...)
+	return nil
+}
+
+// emitByte writes b to out through the buffer.
+func (x *expander) emitByte(b byte) error {
+	if len(x.buf) >= expanderBufferSize {
+		if err := x.flush(); err != nil {
+			return err
+		}
+	}
+
+	x.buf = append(x.buf, b)
+	return nil
+}
+
+// flush writes the buffer to out.
+func (x *expander) flush() error {
+	if len(x.buf) == 0 {
+		return nil
+	}
+
+	_, err := x.out.Write(x.buf)
+	x.buf = x.buf[:0]
+	return err
+}
+
+// passThrough reports whether b is written to out as it is, without changing the states but the scanner.
+func (x *expander) passThrough(b byte) bool {
+	if !x.onString {
+		return b != '"'
+	}
+	return x.streamState == stateNotValue && !x.escaping && b != '"' && b != '\\'
+}
+
+// step processes a byte.
+func (x *expander) step(b byte) error {
+	_ = x.s.step(b) // never fails without validations
+
+	if x.onString {
+		if x.escaping {
+			x.escaping = false
+		} else if b == '\\' {
+			x.escaping = true
+		} else if b == '"' {
+			x.onString = false
+		}
+
+		if x.streamState == stateNotValue {
+			if err := x.emitByte(b); err != nil {
+				return err
+			}
+		} else {
+			_ = x.stringBuf.WriteByte(b)
+
+			if x.streamState == stateUndetermined {
+				if x.stringBuf.Len() >= len(x.w.markerJSON) {
+					if strings.HasPrefix(x.stringBuf.String(), x.w.markerJSON) {
+						x.streamState = stateValue
+					} else {
+						x.streamState = stateNotValue
+
+						// flush the buffer
+						if err := x.emit(x.stringBuf.Bytes()); err != nil {
+							return err
+						}
+						x.releaseStringBuf()
+					}
+				}
+			}
+
+			if max := x.w.maxMarkerBuffer; max > 0 && x.streamState != stateNotValue && x.stringBuf.Len() > max {
+				// too long for a placeholder, so written verbatim.
+				x.streamState = stateNotValue
+
+				// flush the buffer
+				if err := x.emit(x.stringBuf.Bytes()); err != nil {
+					return err
+				}
+				x.releaseStringBuf()
+			}
+		}
+
+		if !x.onString {
+			// finish string
+			defer x.releaseStringBuf()
+
+			if x.streamState == stateUndetermined {
+				// flush the buffer
+				if err := x.emit(x.stringBuf.Bytes()); err != nil {
+					return err
+				}
+			} else if x.streamState == stateValue {
+				// process streaming!!
+				s, err := decodePlaceholder(x.stringBuf.Bytes(), x.w.marker, x.w.markerJSON)
+				if err != nil {
+					return err
+				}
+				marker := x.w.marker + x.w.nonce
+				if !strings.HasPrefix(s, marker) {
+					// genuine data which happens to start with the prefix.
+					return x.emit(x.stringBuf.Bytes())
+				}
+				key := s[len(marker):]
+				if x.scoped {
+					if sub, _ := x.w.subFor(key); sub == nil {
+						return x.emit(x.stringBuf.Bytes())
+					}
+				}
+
+				// not needed while the value is streamed.
+				x.releaseStringBuf()
+
+				if err := x.flush(); err != nil {
+					return err
+				}
+				if err := x.w.streamValue(x.ctx, x.out, key, len(x.s.stack)); err != nil {
+					return err
+				}
+
+				if err := x.w.valueBoundary(x.ctx); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	if b == '"' {
+		// start string
+		x.onString = true
+		x.escaping = false
+
+		if x.s.onKey {
+			// object keys are never placeholders, so written straight through.
+			x.streamState = stateNotValue
+			if err := x.emitByte(b); err != nil {
+				return err
+			}
+			return nil
+		}
+
+		x.streamState = stateUndetermined
+		x.stringBuf = stringBufPool.Get().(*bytes.Buffer)
+		x.stringBuf.Reset()
+		_ = x.stringBuf.WriteByte('"')
+		return nil
+	}
+
+	if err := x.emitByte(b); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// stringBufPool pools the buffers of strings in value position, which are shared by all the expanders,
+// so that Writers don't hold them while no such string is being processed.
+var stringBufPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// maxPooledStringBuf is the maximum capacity of the buffers returned to stringBufPool,
+// so that a buffer grown by a giant string is not kept.
+const maxPooledStringBuf = 64 * 1024
+
+// releaseStringBuf returns the buffer of the string to stringBufPool.
+// It is called as soon as the string turns out not to be a placeholder, or at the end of the string.
+func (x *expander) releaseStringBuf() {
+	if x.stringBuf == nil {
+		return
+	}
+
+	if x.stringBuf.Cap() <= maxPooledStringBuf {
+		stringBufPool.Put(x.stringBuf)
+	}
+	x.stringBuf = nil
+}
+
+// decodePlaceholder decodes quoted, a JSON string starting with markerJSON, which is the encoded form of marker.
+// It unescapes the common escapes by itself, and falls back to json.Unmarshal only for \u escapes.
+func decodePlaceholder(quoted []byte, marker, markerJSON string) (string, error) {
+	if len(quoted) < len(markerJSON)+1 || !bytes.HasPrefix(quoted, []byte(markerJSON)) || quoted[len(quoted)-1] != '"' {
+		return "", fmt.Errorf("invalid placeholder: %s", quoted)
+	}
+
+	rest := quoted[len(markerJSON) : len(quoted)-1]
+	if bytes.IndexByte(rest, '\\') < 0 {
+		return marker + string(rest), nil
+	}
+
+	buf := make([]byte, 0, len(marker)+len(rest))
+	buf = append(buf, marker...)
+	for i := 0; i < len(rest); i++ {
+		b := rest[i]
+		if b != '\\' {
+			buf = append(buf, b)
+			continue
+		}
+
+		i++
+		if i == len(rest) {
+			return "", fmt.Errorf("invalid placeholder: %s", quoted)
+		}
+		switch rest[i] {
+		case '"', '\\', '/':
+			buf = append(buf, rest[i])
+		case 'b':
+			buf = append(buf, '\b')
+		case 'f':
+			buf = append(buf, '\f')
+		case 'n':
+			buf = append(buf, '\n')
+		case 'r':
+			buf = append(buf, '\r')
+		case 't':
+			buf = append(buf, '\t')
+		default:
+			// \u escapes including surrogate pairs are rare in keys.
+			var s string
+			if err := json.Unmarshal(quoted, &s); err != nil {
+				return "", err
+			}
+			return s, nil
+		}
+	}
+
+	return string(buf), nil
+}
@@ -0,0 +1,16 @@
+package writer
+
+import "time"
+
+// SetClock replaces the clock of w for testing.
+func SetClock(w *Writer, now func() time.Time) {
+	w.now = now
+}
+
+// PendingDrains returns the number of Drain calls waiting for a safe boundary.
+func PendingDrains(w *Writer) int {
+	w.Lock()
+	defer w.Unlock()
+
+	return len(w.drains)
+}
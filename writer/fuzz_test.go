@@ -0,0 +1,109 @@
+package writer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+// placeholderPrefix marks the strings in fuzzed documents which are replaced by placeholders.
+const placeholderPrefix = "@"
+
+// withPlaceholders replaces the strings starting with placeholderPrefix in doc by Values of w,
+// and returns the document to encode and the expected result.
+func withPlaceholders(w *writer.Writer, doc interface{}, seq *int) (interface{}, interface{}) {
+	switch d := doc.(type) {
+	case map[string]interface{}:
+		input, expected := map[string]interface{}{}, map[string]interface{}{}
+		for k, v := range d {
+			input[k], expected[k] = withPlaceholders(w, v, seq)
+		}
+		return input, expected
+	case []interface{}:
+		input, expected := make([]interface{}, len(d)), make([]interface{}, len(d))
+		for i, v := range d {
+			input[i], expected[i] = withPlaceholders(w, v, seq)
+		}
+		return input, expected
+	case string:
+		if !strings.HasPrefix(d, placeholderPrefix) {
+			return d, d
+		}
+		*seq++
+		content := map[string]interface{}{"content": d[len(placeholderPrefix):]}
+		v := w.MustNewValue(fmt.Sprint(*seq), func(w io.Writer) error {
+			return json.NewEncoder(w).Encode(content)
+		})
+		return v, content
+	default:
+		return d, d
+	}
+}
+
+func FuzzWrite(f *testing.F) {
+	for _, doc := range []string{
+		`"@a"`,
+		`{"a":"@b","@c":["@d",1,true,null]}`,
+		`{"\\🎏":"\\🎏","🎏":["\\\\🎏","@\\🎏"]}`,
+		`[{"a\"b":"c\\\"d"},"@\"",{"@":{"@":"@"}}]`,
+		`{"x":"\🎏","y":"<&>","z":"@日本語"}`,
+	} {
+		f.Add(doc, uint8(1))
+		f.Add(doc, uint8(5))
+	}
+
+	f.Fuzz(func(t *testing.T, input string, chunk uint8) {
+		var doc interface{}
+		if err := json.Unmarshal([]byte(input), &doc); err != nil {
+			t.Skip()
+		}
+
+		buf := new(bytes.Buffer)
+		w := writer.New(buf, writer.WithNonce(), writer.WithMaxMarkerBuffer(0))
+
+		var seq int
+		in, expected := withPlaceholders(w, doc, &seq)
+		jsn, err := json.Marshal(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// written in chunks, which may split escapes and placeholders.
+		size := int(chunk)%8 + 1
+		for p := jsn; len(p) > 0; {
+			n := size
+			if n > len(p) {
+				n = len(p)
+			}
+			if _, err := w.Write(p[:n]); err != nil {
+				t.Fatalf("writing %s: %v", jsn, err)
+			}
+			p = p[n:]
+		}
+
+		var actual interface{}
+		if err := json.Unmarshal(buf.Bytes(), &actual); err != nil {
+			t.Fatalf("invalid output %s: %v", buf, err)
+		}
+
+		// the expected result is normalized through JSON as well.
+		ejsn, err := json.Marshal(expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var normalized interface{}
+		if err := json.Unmarshal(ejsn, &normalized); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(actual, normalized) {
+			t.Fatalf("output differs\nexpected:%s\nactual:  %s", ejsn, buf)
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package writer_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+// gzipDocument writes a document with a large array to w.
+func gzipDocument(w *writer.Writer) error {
+	type item struct {
+		ID   int
+		Name string
+		Tags []string
+	}
+
+	root := struct {
+		Title string
+		Items *writer.Value
+	}{
+		Title: `"escaped" title`,
+		Items: w.MustNewArrayValue("items", func(w writer.ElementWriter) error {
+			for i := 0; i < 1000; i++ {
+				if err := w.WriteElement(&item{ID: i, Name: fmt.Sprintf(`item "%d"`, i), Tags: []string{"a", "b"}}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+	}
+
+	return w.Encode(&root)
+}
+
+// writeCounter counts the Write calls to w.
+type writeCounter struct {
+	w     io.Writer
+	calls int
+	bytes int
+}
+
+func (wc *writeCounter) Write(p []byte) (int, error) {
+	wc.calls++
+	wc.bytes += len(p)
+	return wc.w.Write(p)
+}
+
+func TestWriteGzip(t *testing.T) {
+	plain := new(bytes.Buffer)
+	if err := gzipDocument(writer.New(plain)); err != nil {
+		t.Fatal(err)
+	}
+
+	compressed := new(bytes.Buffer)
+	zw := gzip.NewWriter(compressed)
+	wc := &writeCounter{w: zw}
+	if err := gzipDocument(writer.New(wc)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the output is coalesced into writes of several bytes on average, not written byte by byte.
+	if avg := wc.bytes / wc.calls; avg < 8 {
+		t.Fatalf("average bytes per write expected at least 8, but was %d in %d writes", avg, wc.calls)
+	}
+
+	zr, err := gzip.NewReader(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := ioutil.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, plain.Bytes()) {
+		t.Fatalf("decompressed output differs\nexpected:%s\nactual:  %s", plain, decompressed)
+	}
+}
+
+func BenchmarkWriteGzip(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		zw := gzip.NewWriter(ioutil.Discard)
+		if err := gzipDocument(writer.New(zw)); err != nil {
+			b.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// Example_gzip streams a document directly into gzip.Writer, e.g. for an HTTP response with Content-Encoding: gzip.
+func Example_gzip() {
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+
+	w := writer.New(zw)
+	root := struct {
+		Numbers *writer.Value
+	}{
+		Numbers: w.MustNewArrayValue("numbers", func(w writer.ElementWriter) error {
+			return w.WriteElements(1, 2, 3)
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		panic(err)
+	}
+	if err := zw.Close(); err != nil {
+		panic(err)
+	}
+
+	zr, err := gzip.NewReader(&compressed)
+	if err != nil {
+		panic(err)
+	}
+	if _, err := io.Copy(os.Stdout, zr); err != nil {
+		panic(err)
+	}
+	// Output: {"Numbers":[1,2,3]}
+}
@@ -0,0 +1,31 @@
+package writer
+
+import (
+	"hash"
+	"io"
+)
+
+// hashWriter feeds all the bytes written to w into h.
+type hashWriter struct {
+	w io.Writer
+	h hash.Hash
+}
+
+func (hw *hashWriter) Write(p []byte) (int, error) {
+	n, err := hw.w.Write(p)
+	_, _ = hw.h.Write(p[:n])
+	return n, err
+}
+
+func (hw *hashWriter) Flush() error {
+	return flush(hw.w)
+}
+
+// Sum returns the hash of the whole output given by WithHash.
+// Call it after encoding has finished. It returns nil if WithHash is not given.
+func (w *Writer) Sum() []byte {
+	if w.hash == nil {
+		return nil
+	}
+	return w.hash.Sum(nil)
+}
@@ -0,0 +1,59 @@
+package writer_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+func sumDocument(t *testing.T, value string) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithHash(sha256.New()))
+
+	root := struct {
+		Name  string
+		Value *writer.Value
+	}{
+		Name: "root",
+		Value: w.MustNewValue("value", func(w io.Writer) error {
+			_, err := w.Write([]byte(value))
+			return err
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := sha256.Sum256(buf.Bytes()), w.Sum(); !bytes.Equal(actual, expected[:]) {
+		t.Fatalf("sum of output expected:%x, but was %x", expected, actual)
+	}
+
+	return w.Sum()
+}
+
+func TestSum(t *testing.T) {
+	s1 := sumDocument(t, `[1,2,3]`)
+	s2 := sumDocument(t, `[1,2,3]`)
+	s3 := sumDocument(t, `[1,2,4]`)
+
+	if !bytes.Equal(s1, s2) {
+		t.Errorf("identical documents must have identical sums, but were %x and %x", s1, s2)
+	}
+	if bytes.Equal(s1, s3) {
+		t.Errorf("different documents must have different sums, but both were %x", s1)
+	}
+}
+
+func TestSumWithoutHash(t *testing.T) {
+	w := writer.New(new(bytes.Buffer))
+	if sum := w.Sum(); sum != nil {
+		t.Errorf("nil expected, but was %x", sum)
+	}
+}
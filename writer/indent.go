@@ -0,0 +1,88 @@
+package writer
+
+import (
+	"context"
+	"io"
+)
+
+// indentWriter indents the JSON value passed through it like json.Indent, without buffering the value.
+// Insignificant whitespace outside of strings is dropped, and line breaks are inserted as the bytes arrive.
+type indentWriter struct {
+	w      io.Writer
+	prefix string
+	indent string
+	s      scanner
+	opened bool // just after '{' or '[', whose line break waits to tell whether the container is empty
+	buf    []byte
+}
+
+func (iw *indentWriter) Write(p []byte) (int, error) {
+	iw.buf = iw.buf[:0]
+	for _, b := range p {
+		if iw.s.onString {
+			_ = iw.s.step(b)
+			iw.buf = append(iw.buf, b)
+			continue
+		}
+		if b == ' ' || b == '\t' || b == '\n' || b == '\r' {
+			continue
+		}
+
+		if iw.opened {
+			iw.opened = false
+			if b == '}' || b == ']' {
+				// empty container stays on the line.
+				_ = iw.s.step(b)
+				iw.buf = append(iw.buf, b)
+				continue
+			}
+			iw.newline()
+		}
+
+		_ = iw.s.step(b)
+		switch b {
+		case '{', '[':
+			iw.buf = append(iw.buf, b)
+			iw.opened = true
+		case ',':
+			iw.buf = append(iw.buf, b)
+			iw.newline()
+		case ':':
+			iw.buf = append(iw.buf, ':', ' ')
+		case '}', ']':
+			iw.newline()
+			iw.buf = append(iw.buf, b)
+		default:
+			iw.buf = append(iw.buf, b)
+		}
+	}
+
+	if len(iw.buf) > 0 {
+		if _, err := iw.w.Write(iw.buf); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (iw *indentWriter) Flush() error {
+	return flush(iw.w)
+}
+
+// newline starts a new line indented to the current depth.
+func (iw *indentWriter) newline() {
+	iw.buf = append(iw.buf, '\n')
+	iw.buf = append(iw.buf, iw.prefix...)
+	for i := 0; i < len(iw.s.stack); i++ {
+		iw.buf = append(iw.buf, iw.indent...)
+	}
+}
+
+type indentingKey struct{}
+
+// indenting returns ctx for rendering a value through an indentWriter,
+// in which the nested values are left to the enclosing indentWriter.
+func indenting(ctx context.Context) context.Context {
+	return context.WithValue(ctx, indentingKey{}, true)
+}
@@ -0,0 +1,43 @@
+package writer
+
+import "io"
+
+// minifyWriter strips insignificant whitespace outside of JSON strings.
+type minifyWriter struct {
+	w        io.Writer
+	onString bool
+	escaping bool
+	buf      []byte
+}
+
+func (mw *minifyWriter) Write(p []byte) (int, error) {
+	mw.buf = mw.buf[:0]
+	for _, b := range p {
+		if mw.onString {
+			if mw.escaping {
+				mw.escaping = false
+			} else if b == '\\' {
+				mw.escaping = true
+			} else if b == '"' {
+				mw.onString = false
+			}
+		} else if b == '"' {
+			mw.onString = true
+		} else if b == ' ' || b == '\t' || b == '\n' || b == '\r' {
+			continue
+		}
+		mw.buf = append(mw.buf, b)
+	}
+
+	if len(mw.buf) > 0 {
+		if _, err := mw.w.Write(mw.buf); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (mw *minifyWriter) Flush() error {
+	return flush(mw.w)
+}
@@ -0,0 +1,37 @@
+package writer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+func TestWithMinify(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithMinify(true))
+
+	root := struct {
+		Name   string
+		Pretty *writer.Value
+	}{
+		Name: "white space\tinside\nstring",
+		Pretty: w.MustNewValue("pretty", func(w io.Writer) error {
+			_, err := w.Write([]byte("{\n  \"a b\": [\n    1,\n    \"\\\" x \"\n  ],\r\n\t\"c\": {}\n}"))
+			return err
+		}),
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Name":"white space\tinside\nstring","Pretty":{"a b":[1,"\" x "],"c":{}}}`
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
@@ -0,0 +1,129 @@
+package writer
+
+import (
+	"context"
+	"io"
+)
+
+// ObjectWriter encodes and writes object members.
+type ObjectWriter interface {
+	// WriteMember encodes and writes an object member.
+	// Duplicate keys are written as they are, so it is the caller's responsibility to avoid them.
+	WriteMember(key string, value interface{}) error
+}
+
+// ObjectValueFunc is a callback function, in which you can write each members of an object to w.
+type ObjectValueFunc func(w ObjectWriter) error
+
+// NewObjectValue creates a Value which describes JSON object.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewObjectValue(key string, f ObjectValueFunc) (*Value, error) {
+	return w.newValue(key, f)
+}
+
+// MustNewObjectValue creates a Value which describes JSON object.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewObjectValue(key string, f ObjectValueFunc) *Value {
+	return w.mustNewValue(key, f)
+}
+
+type objectWriter struct {
+	parent    *Writer
+	ctx       context.Context
+	w         io.Writer
+	following bool
+	x         *expander // reused to expand members
+}
+
+func (ow *objectWriter) WriteMember(key string, value interface{}) error {
+	k, err := ow.parent.marshal(key)
+	if err != nil {
+		return err
+	}
+
+	jsn, err := ow.parent.marshal(value)
+	if err != nil {
+		return err
+	}
+
+	if ow.following {
+		if _, err := ow.w.Write([]byte(",")); err != nil {
+			return err
+		}
+	} else {
+		ow.following = true
+	}
+
+	if _, err := ow.w.Write(append(k, ':')); err != nil {
+		return err
+	}
+
+	// Values in value are expanded as well as the top-level ones.
+	if ow.x == nil {
+		ow.x = ow.parent.newExpander(ow.ctx, ow.w)
+	}
+	if _, err := ow.x.Write(jsn); err != nil {
+		return err
+	}
+
+	return ow.parent.valueBoundary(ow.ctx)
+}
+
+// MapWriter writes object entries whose values are streamed by callbacks.
+type MapWriter interface {
+	// WriteEntry writes an object entry, whose value is written by vf.
+	// Duplicate keys are written as they are, so it is the caller's responsibility to avoid them.
+	WriteEntry(key string, vf ValueFunc) error
+}
+
+// MapValueFunc is a callback function, in which you can write each entries of an object to w.
+type MapValueFunc func(w MapWriter) error
+
+// NewMapValue creates a Value which describes JSON object whose entries are streamed one by one.
+// Unlike NewObjectValue, the value of each entry is streamed by a callback as well, so the object is never materialized.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewMapValue(key string, f MapValueFunc) (*Value, error) {
+	return w.newValue(key, f)
+}
+
+// MustNewMapValue creates a Value which describes JSON object whose entries are streamed one by one.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewMapValue(key string, f MapValueFunc) *Value {
+	return w.mustNewValue(key, f)
+}
+
+type mapWriter struct {
+	parent    *Writer
+	ctx       context.Context
+	w         io.Writer
+	following bool
+}
+
+func (mw *mapWriter) WriteEntry(key string, vf ValueFunc) error {
+	k, err := mw.parent.marshal(key)
+	if err != nil {
+		return err
+	}
+
+	if mw.following {
+		if _, err := mw.w.Write([]byte(",")); err != nil {
+			return err
+		}
+	} else {
+		mw.following = true
+	}
+
+	if _, err := mw.w.Write(append(k, ':')); err != nil {
+		return err
+	}
+
+	if err := vf(&flushWriter{mw.w}); err != nil {
+		return err
+	}
+
+	return mw.parent.valueBoundary(mw.ctx)
+}
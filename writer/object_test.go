@@ -0,0 +1,82 @@
+package writer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+func TestObjectValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	root := struct {
+		Users *writer.Value
+		Empty *writer.Value
+	}{
+		Users: w.MustNewObjectValue("users", func(ow writer.ObjectWriter) error {
+			for i := 1; i <= 2; i++ {
+				if err := ow.WriteMember(fmt.Sprintf("user%d", i), map[string]int{"id": i}); err != nil {
+					return err
+				}
+			}
+			if err := ow.WriteMember(`"quoted"`, "escaped"); err != nil {
+				return err
+			}
+			return ow.WriteMember("nested", w.MustNewArrayValue("nested", func(ew writer.ElementWriter) error {
+				return ew.WriteElement(1)
+			}))
+		}),
+		Empty: w.MustNewObjectValue("empty", func(ow writer.ObjectWriter) error {
+			return nil
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Users":{"user1":{"id":1},"user2":{"id":2},"\"quoted\"":"escaped","nested":[1]},"Empty":{}}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestMapValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	root := struct {
+		Things *writer.Value
+		Empty  *writer.Value
+	}{
+		Things: w.MustNewMapValue("things", func(mw writer.MapWriter) error {
+			for _, key := range []string{"a", `"b"`} {
+				key := key
+				if err := mw.WriteEntry(key, func(w io.Writer) error {
+					_, err := fmt.Fprintf(w, "[%q]", key)
+					return err
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+		Empty: w.MustNewMapValue("empty", func(mw writer.MapWriter) error {
+			return nil
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Things":{"a":["a"],"\"b\"":["\"b\""]},"Empty":{}}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
@@ -0,0 +1,395 @@
+package writer
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"time"
+)
+
+// Option configures a Writer.
+type Option func(*Writer)
+
+// WithContext sets ctx which is passed to context-aware callbacks.
+// ctx is passed as it is, so request-scoped values in it are accessible from the callbacks.
+// Once ctx is done, ctx.Err() is returned when a placeholder is reached, without calling the callback.
+func WithContext(ctx context.Context) Option {
+	return func(w *Writer) {
+		w.ctx = ctx
+	}
+}
+
+// WithNonce makes placeholders contain a random nonce generated for the Writer after Sentinel,
+// so that genuine string values starting with Sentinel are written verbatim instead of being taken as placeholders.
+// Only strings starting with Sentinel followed by the nonce are expanded,
+// which can't be produced by chance, but note that the placeholders of other Writers are written verbatim too.
+// Without it, every string value starting with Sentinel is taken as a placeholder.
+func WithNonce() Option {
+	return func(w *Writer) {
+		w.nonce = newNonce()
+	}
+}
+
+// newNonce generates a random nonce, which can't collide with others by chance.
+func newNonce() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// WithMarker replaces the prefix of placeholders, which is Sentinel by default, e.g. with ASCII one.
+// It should be long enough not to collide with genuine string values, and consist of characters
+// which json.Encoder writes as they are. It panics when prefix is empty.
+func WithMarker(prefix string) Option {
+	if prefix == "" {
+		panic("writer: empty marker")
+	}
+
+	jsn, err := json.Marshal(prefix)
+	if err != nil {
+		panic(err)
+	}
+
+	return func(w *Writer) {
+		w.marker = prefix
+		w.markerJSON = string(jsn[:len(jsn)-1])
+	}
+}
+
+// WithPrettyValues makes streamed values indented with indent.
+// Values are indented as they are streamed like json.Indent, without being buffered,
+// while the surrounding structure written by json.Encoder stays as it is.
+// NDJSON values fail, since indenting would split the elements across lines.
+func WithPrettyValues(indent string) Option {
+	return func(w *Writer) {
+		w.prettyValues = true
+		w.prettyIndent = indent
+	}
+}
+
+// WithIndent makes streamed values indented consistently with the surrounding structure
+// written by json.Encoder with SetIndent(prefix, indent).
+// Give the same prefix and indent as the ones given to SetIndent.
+// Like WithPrettyValues, values are indented as they are streamed, and NDJSON values fail.
+func WithIndent(prefix, indent string) Option {
+	return func(w *Writer) {
+		w.prettyValues = true
+		w.prettyPrefix = prefix
+		w.prettyIndent = indent
+		w.indentAware = true
+	}
+}
+
+// WithValueTTL makes registered values expire after ttl.
+// Expired values are removed lazily when another value is registered, to cap memory of long-lived Writers.
+// Expiry doesn't know whether the placeholder is about to be reached,
+// so if a value expires before its placeholder is written, encoding fails with ErrUnknownKey.
+// ttl must be long enough to cover the time from registration to the end of encoding.
+func WithValueTTL(ttl time.Duration) Option {
+	return func(w *Writer) {
+		w.ttl = ttl
+	}
+}
+
+// WithRateLimit caps the byte rate of the whole output with a token bucket,
+// which allows bursts of up to burst bytes.
+// Waiting for tokens ends with ctx.Err() once the context given by WithContext is done,
+// and throttling is suspended while Drain waits for a safe boundary.
+// It is disabled if bytesPerSec is not positive.
+func WithRateLimit(bytesPerSec int, burst int) Option {
+	return func(w *Writer) {
+		w.bytesPerSec = bytesPerSec
+		w.burst = burst
+	}
+}
+
+// WithExpectedValues makes Writer allocate the registry of values for n values beforehand,
+// to save growing it when a large number of values are registered.
+// It is just a hint, so more values can be registered.
+func WithExpectedValues(n int) Option {
+	return func(w *Writer) {
+		w.expectedValues = n
+	}
+}
+
+// WithMaxReverseBuffer limits the size in bytes of the array buffered by a reversed array value.
+// ErrBufferLimitExceeded is returned when the limit is exceeded. It is unlimited if n is not positive.
+func WithMaxReverseBuffer(n int) Option {
+	return func(w *Writer) {
+		w.maxReverseBuffer = n
+	}
+}
+
+// WithMaxUniqueKeys limits the number of the keys remembered by WriteElementUnique for each array.
+// ErrBufferLimitExceeded is returned when the limit is exceeded. It is unlimited if n is not positive.
+func WithMaxUniqueKeys(n int) Option {
+	return func(w *Writer) {
+		w.maxUniqueKeys = n
+	}
+}
+
+// WithTimeBudget configures the total time budget for the whole document, which starts at the first Write.
+// Once the budget is exhausted, null is written in place of the values marked by Value.MarkSkippable,
+// so that the rest of the document is written promptly.
+func WithTimeBudget(d time.Duration) Option {
+	return func(w *Writer) {
+		w.budget = d
+	}
+}
+
+// WithMaxMarkerBuffer limits the size in bytes of a string value buffered to tell whether it is a placeholder.
+// A longer string is written verbatim even if it starts with the marker, so keys must be shorter than the limit.
+// It is 64KiB by default, and unlimited if n is not positive.
+func WithMaxMarkerBuffer(n int) Option {
+	return func(w *Writer) {
+		w.maxMarkerBuffer = n
+	}
+}
+
+// WithErrorObject configures the object written in place of a fallible value whose callback failed.
+// The result of f is encoded by json.Marshal.
+func WithErrorObject(f func(key string, err error) interface{}) Option {
+	return func(w *Writer) {
+		w.errorObject = f
+	}
+}
+
+// WithHash makes the whole output written to h, so that its hash is available from Writer.Sum,
+// e.g. for ETag generation.
+func WithHash(h hash.Hash) Option {
+	return func(w *Writer) {
+		w.hash = h
+	}
+}
+
+// WithCircuitBreaker sets cb as the CircuitBreaker of group, which guards values created by NewGuardedValue.
+func WithCircuitBreaker(group string, cb CircuitBreaker) Option {
+	return func(w *Writer) {
+		if w.breakers == nil {
+			w.breakers = map[string]CircuitBreaker{}
+		}
+		w.breakers[group] = cb
+	}
+}
+
+// WithSchema makes the whole document validated by v.
+// The document is buffered in memory, and is written to the destination by Close only when it is valid.
+func WithSchema(v SchemaValidator) Option {
+	return func(w *Writer) {
+		w.schema = v
+	}
+}
+
+// WithSkipNilElements makes ElementWriter.WriteElement skip nil elements, including nil pointers, maps and slices.
+// Use ElementWriter.WriteNull to write null explicitly.
+func WithSkipNilElements() Option {
+	return func(w *Writer) {
+		w.skipNilElements = true
+	}
+}
+
+// WithCheckRawElements makes ElementWriter.WriteRawElement validate elements by json.Valid before written.
+// An invalid element is returned as error without written.
+func WithCheckRawElements() Option {
+	return func(w *Writer) {
+		w.checkRawElements = true
+	}
+}
+
+// WithValidation makes streamed values validated as they are written,
+// so that a callback writing malformed JSON fails fast with an error naming the key.
+// The malformed bytes are not written to the destination.
+// A callback writing nothing fails with ErrEmptyValue, while an array value with no elements is valid as [].
+func WithValidation() Option {
+	return func(w *Writer) {
+		w.validation = true
+	}
+}
+
+// WithAutoFlush makes the destination flushed at the end of each streamed value, array element and object member,
+// if it implements Flusher or http.Flusher, so that a client receives the data incrementally.
+func WithAutoFlush() Option {
+	return func(w *Writer) {
+		w.autoFlush = true
+	}
+}
+
+// WithConcurrency makes all the registered values rendered concurrently into buffers with n workers on the first Write,
+// and the buffers are written when the placeholders are reached, so that slow callbacks overlap their latency.
+// Values registered after the first Write are rendered when their placeholders are reached as usual.
+// Callbacks must be safe to run concurrently and before their placeholders are reached.
+func WithConcurrency(n int) Option {
+	return func(w *Writer) {
+		w.concurrency = n
+	}
+}
+
+// WithEscapeHTML configures whether <, > and & in the strings encoded by Writer are escaped, which is true by default,
+// e.g. the elements written by ElementWriter.WriteElement, the members written by ObjectWriter.WriteMember,
+// and the values encoded by the constructors such as NewLazyStructValue and NewMarkdownHTMLValue.
+// Writer.Encode configures its json.Encoder as well. Otherwise give the same flag to json.Encoder.SetEscapeHTML,
+// so that escaping is uniform across the whole document.
+func WithEscapeHTML(on bool) Option {
+	return func(w *Writer) {
+		w.escapeHTML = on
+	}
+}
+
+// WithUnsafeNoLock makes Writer skip locking its mutex, e.g. to save the overhead in hot registration loops.
+// Then Writer is not safe for concurrent use at all, so everything including registering values must be done
+// by the goroutine writing the document. WithConcurrency and Drain, which involve other goroutines, must not be used.
+func WithUnsafeNoLock() Option {
+	return func(w *Writer) {
+		w.noLock = true
+	}
+}
+
+// WithCompactKeys makes each registered value assigned a compact integer id, which is put in its placeholder
+// instead of the key, so that placeholders of long keys, e.g. JSONPath-like ones, stay short.
+// The keys are still used for registration and reported in errors and hooks.
+func WithCompactKeys() Option {
+	return func(w *Writer) {
+		w.compactKeys = true
+	}
+}
+
+// UnknownKeyPolicy is the behavior when a placeholder of unregistered key is reached.
+type UnknownKeyPolicy int
+
+const (
+	// PolicyError makes encoding fail with ErrUnknownKey, which is the default.
+	PolicyError UnknownKeyPolicy = iota
+	// PolicyNull makes null written in place of the placeholder.
+	PolicyNull
+	// PolicySkip makes nothing written in place of the placeholder.
+	// Note that the document is invalid JSON then, e.g. {"key":} or [1,,2],
+	// so it is only for the consumers which are aware of it.
+	PolicySkip
+)
+
+// WithUnknownKeyPolicy configures the behavior when a placeholder of unregistered key is reached,
+// e.g. in a plugin architecture where some keys may be optionally registered.
+func WithUnknownKeyPolicy(policy UnknownKeyPolicy) Option {
+	return func(w *Writer) {
+		w.unknownKeyPolicy = policy
+	}
+}
+
+// TimeoutPolicy is the behavior when the element of ElementWriter.WriteElementTimeout is not produced in time.
+type TimeoutPolicy int
+
+const (
+	// TimeoutNull makes null written in place of the element, which is the default.
+	TimeoutNull TimeoutPolicy = iota
+	// TimeoutSkip makes the element omitted from the array.
+	TimeoutSkip
+	// TimeoutError makes WriteElementTimeout fail with context.DeadlineExceeded.
+	TimeoutError
+)
+
+// WithTimeoutPolicy configures the behavior when the element of ElementWriter.WriteElementTimeout is not produced in time.
+func WithTimeoutPolicy(policy TimeoutPolicy) Option {
+	return func(w *Writer) {
+		w.timeoutPolicy = policy
+	}
+}
+
+// ArrayOption configures an array value.
+type ArrayOption func(v *Value)
+
+// WithElementAggregator makes each element written to the array passed to f,
+// so that a summary can be computed in the single pass.
+// To write the summary as another value, it must be placed after the array in the document.
+// f is called with nil for elements written by ElementWriter.WriteNull.
+func WithElementAggregator(f func(e interface{})) ArrayOption {
+	return func(v *Value) {
+		v.aggregator = f
+	}
+}
+
+// WithElementEncoder makes each element written by ElementWriter.WriteElement encoded by f instead of json.Marshal,
+// e.g. to apply custom settings or to use another JSON library, while the brackets and separators are written as usual.
+// f must return a valid JSON value. Placeholders in its output are expanded as well.
+func WithElementEncoder(f func(e interface{}) ([]byte, error)) ArrayOption {
+	return func(v *Value) {
+		v.encoder = f
+	}
+}
+
+// WithMinify strips insignificant whitespace from the whole output if minify is true,
+// including the output of callbacks and the indentation by json.Encoder.
+// NDJSON values fail, since their lines would be joined.
+func WithMinify(minify bool) Option {
+	return func(w *Writer) {
+		w.minify = minify
+	}
+}
+
+// WithDuplicateKeyCheck makes Writer validate that no object written by json.Encoder has duplicate keys,
+// which json.Unmarshal silently tolerates. ErrDuplicateObjectKey is returned when found.
+// Streamed values are not validated.
+func WithDuplicateKeyCheck() Option {
+	return func(w *Writer) {
+		if w.scan == nil {
+			w.scan = &scanner{}
+		}
+		w.scan.checkDuplicateKeys = true
+	}
+}
+
+// WithAuditLogger sets f which is called with the key of each value just before it is expanded,
+// so that which values were emitted in the response can be recorded for security auditing.
+// It is called even if the value is empty or its callback fails in the middle, since a part of it may have been emitted.
+// It is called once for each value, even if its placeholder is reached multiple times, e.g. a shared value,
+// and not called for canceled values.
+func WithAuditLogger(f func(key string)) Option {
+	return func(w *Writer) {
+		w.auditLogger = f
+	}
+}
+
+// WithValueHook adds f which is called with the key of each value just before it is expanded,
+// and the function returned by f is called with the result when the expansion finishes,
+// e.g. to measure the duration or to start and end a tracing span.
+// Hooks given multiple times are called in order, and the returned functions in reverse order.
+// Like WithAuditLogger, they are not called for canceled values.
+func WithValueHook(f func(key string) func(err error)) Option {
+	return WithValueHookCtx(func(ctx context.Context, key string) func(err error) {
+		return f(key)
+	})
+}
+
+// WithValueHookCtx adds a context-aware hook like WithValueHook.
+// ctx is the one the value is streamed with, e.g. to take the request-scoped values of the span or the metrics.
+func WithValueHookCtx(f func(ctx context.Context, key string) func(err error)) Option {
+	return func(w *Writer) {
+		w.valueHooks = append(w.valueHooks, f)
+	}
+}
+
+// WithMaxNestingDepth makes Writer return ErrMaxNestingDepthExceeded
+// when the document written by json.Encoder is nested deeper than n levels,
+// to protect against adversarial inputs. Streamed values are not counted.
+func WithMaxNestingDepth(n int) Option {
+	return func(w *Writer) {
+		if w.scan == nil {
+			w.scan = &scanner{}
+		}
+		w.scan.maxDepth = n
+	}
+}
+
+// WithRepair enables the repair mode, in which the output of each value is completed on a best-effort basis
+// when its callback leaves it unbalanced, e.g. [1,2 becomes [1,2].
+// Unclosed strings, objects and arrays are closed, and missing values are filled with null,
+// including a value of which nothing is written.
+// log is called with the key and the appended bytes for each repair, so that the corruption can be noticed.
+func WithRepair(log func(key string, appended string)) Option {
+	return func(w *Writer) {
+		w.repair = log
+	}
+}
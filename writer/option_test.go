@@ -0,0 +1,998 @@
+package writer_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+type ctxKey struct{}
+
+func TestWithContext(t *testing.T) {
+	buf := new(bytes.Buffer)
+	ctx := context.WithValue(context.Background(), ctxKey{}, "user1")
+	w := writer.New(buf, writer.WithContext(ctx))
+
+	root := struct {
+		User *writer.Value
+	}{
+		User: w.MustNewValueCtx("user", func(ctx context.Context, w io.Writer) error {
+			user, ok := ctx.Value(ctxKey{}).(string)
+			if !ok {
+				return fmt.Errorf("no user in context")
+			}
+			jsn, err := json.Marshal(user)
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(jsn)
+			return err
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := "{\"User\":\"user1\"}\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWithPrettyValues(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithPrettyValues("  "))
+
+	root := struct {
+		Name   string
+		Object *writer.Value
+		Array  *writer.Value
+	}{
+		Name: "root",
+		Object: w.MustNewValue("object", func(w io.Writer) error {
+			_, err := w.Write([]byte(`{"A":1,"B":[true,false]}`))
+			return err
+		}),
+		Array: w.MustNewArrayValue("array", func(w writer.ElementWriter) error {
+			for i := 0; i < 2; i++ {
+				if err := w.WriteElement(i); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Name":"root","Object":{
+  "A": 1,
+  "B": [
+    true,
+    false
+  ]
+},"Array":[
+  0,
+  1
+]}
+`
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWithValueTTL(t *testing.T) {
+	w := writer.New(new(bytes.Buffer), writer.WithValueTTL(time.Minute))
+
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	writer.SetClock(w, func() time.Time {
+		return now
+	})
+
+	f := func(w io.Writer) error {
+		return nil
+	}
+
+	if _, err := w.NewValue("a", f); err != nil {
+		t.Fatal(err)
+	}
+
+	now = now.Add(30 * time.Second)
+	if _, err := w.NewValue("b", f); err != nil {
+		t.Fatal(err)
+	}
+
+	// "a" is still alive.
+	if _, err := w.NewValue("a", f); err != writer.ErrDuplicateKey {
+		t.Fatalf("ErrDuplicateKey expected, but was %v", err)
+	}
+
+	// "a" expires, and is swept by the next registration.
+	now = now.Add(30 * time.Second)
+	if _, err := w.NewValue("a", f); err != nil {
+		t.Fatalf("expired value must be swept, but was %v", err)
+	}
+
+	// "b" is still alive.
+	if _, err := w.NewValue("b", f); err != writer.ErrDuplicateKey {
+		t.Fatalf("ErrDuplicateKey expected, but was %v", err)
+	}
+}
+
+func TestWithRateLimit(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithRateLimit(1000, 100))
+
+	root := struct {
+		Data *writer.Value
+	}{
+		Data: w.MustNewValue("data", func(w io.Writer) error {
+			_, err := w.Write([]byte(`"` + strings.Repeat("a", 300) + `"`))
+			return err
+		}),
+	}
+
+	start := time.Now()
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	// 312 bytes in total and the first 100 bytes are allowed as burst.
+	if expected := 212 * time.Millisecond; elapsed < expected {
+		t.Errorf("elapsed expected at least %v, but was %v", expected, elapsed)
+	}
+	if expected, actual := 312, buf.Len(); actual != expected {
+		t.Errorf("length expected:%d, but was %d", expected, actual)
+	}
+}
+
+func TestWithRateLimitContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := writer.New(ioutil.Discard, writer.WithContext(ctx), writer.WithRateLimit(10, 10))
+
+	v := w.MustNewValue("data", func(w io.Writer) error {
+		time.AfterFunc(50*time.Millisecond, cancel)
+		_, err := w.Write([]byte(`"` + strings.Repeat("a", 1000) + `"`))
+		return err
+	})
+
+	start := time.Now()
+	if err := w.Encode(v); !errors.Is(err, context.Canceled) {
+		t.Fatalf("context.Canceled expected, but was %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("throttling must stop when ctx is done, but took %v", elapsed)
+	}
+}
+
+func TestWithRateLimitDrain(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithRateLimit(10, 10))
+
+	drained := make(chan error, 1)
+	v := w.MustNewValue("data", func(out io.Writer) error {
+		time.AfterFunc(50*time.Millisecond, func() {
+			drained <- w.Drain(context.Background())
+		})
+		_, err := out.Write([]byte(`"` + strings.Repeat("a", 1000) + `"`))
+		return err
+	})
+
+	start := time.Now()
+	if err := w.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("throttling must stop when Drain is called, but took %v", elapsed)
+	}
+	if err := <-drained; err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := 1003, buf.Len(); actual != expected {
+		t.Errorf("length expected:%d, but was %d", expected, actual)
+	}
+}
+
+func TestWithElementAggregator(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	var count, sum int
+	aggregate := func(e interface{}) {
+		count++
+		sum += e.(int)
+	}
+
+	root := struct {
+		Items *writer.Value
+		Count *writer.Value
+		Total *writer.Value
+	}{
+		Items: w.MustNewArrayValue("items", func(w writer.ElementWriter) error {
+			for i := 1; i <= 4; i++ {
+				if err := w.WriteElement(i); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, writer.WithElementAggregator(aggregate)),
+		Count: w.MustNewValue("count", func(w io.Writer) error {
+			_, err := fmt.Fprint(w, count)
+			return err
+		}),
+		Total: w.MustNewValue("total", func(w io.Writer) error {
+			_, err := fmt.Fprint(w, sum)
+			return err
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"Items":[1,2,3,4],"Count":4,"Total":10}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWithElementEncoder(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	nested := w.MustNewValue("nested", func(w io.Writer) error {
+		_, err := w.Write([]byte(`"nested"`))
+		return err
+	})
+
+	// floats with 2 decimal places.
+	encode := func(e interface{}) ([]byte, error) {
+		if f, ok := e.(float64); ok {
+			return []byte(strconv.FormatFloat(f, 'f', 2, 64)), nil
+		}
+		return json.Marshal(e)
+	}
+
+	root := struct {
+		Prices *writer.Value
+		Plain  *writer.Value
+	}{
+		Prices: w.MustNewArrayValue("prices", func(w writer.ElementWriter) error {
+			return w.WriteElements(1.0, 2.345, nested)
+		}, writer.WithElementEncoder(encode)),
+		Plain: w.MustNewArrayValue("plain", func(w writer.ElementWriter) error {
+			return w.WriteElements(1.0, 2.345)
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"Prices":[1.00,2.35,"nested"],"Plain":[1,2.345]}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWithAuditLogger(t *testing.T) {
+	var keys []string
+	w := writer.New(new(bytes.Buffer), writer.WithAuditLogger(func(key string) {
+		keys = append(keys, key)
+	}))
+
+	root := struct {
+		Secret   *writer.Value
+		Empty    *writer.Value
+		Items    *writer.Value
+		Canceled *writer.Value
+	}{
+		Secret: w.MustNewValue("secret", func(w io.Writer) error {
+			_, err := w.Write([]byte(`"s3cr3t"`))
+			return err
+		}),
+		Empty: w.MustNewValue("empty", func(w io.Writer) error {
+			return nil
+		}),
+		Items: w.MustNewArrayValue("items", func(w writer.ElementWriter) error {
+			return nil
+		}),
+		Canceled: w.MustNewValue("canceled", func(w io.Writer) error {
+			return nil
+		}),
+	}
+	root.Canceled.Cancel()
+
+	// the empty value produces invalid JSON, so write the encoded bytes directly.
+	jsn, err := json.Marshal(&root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(jsn); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := "secret,empty,items", strings.Join(keys, ","); actual != expected {
+		t.Fatalf("audited keys expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWithAuditLoggerOnce(t *testing.T) {
+	var keys []string
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithAuditLogger(func(key string) {
+		keys = append(keys, key)
+	}))
+
+	var calls int
+	shared := w.MustNewSharedValue("shared", func(w io.Writer) error {
+		calls++
+		_, err := w.Write([]byte(`"s"`))
+		return err
+	})
+	other := w.MustNewValue("other", func(w io.Writer) error {
+		_, err := w.Write([]byte("1"))
+		return err
+	})
+
+	if err := w.Encode([]*writer.Value{shared, other, shared}); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `["s",1,"s"]`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+	if calls != 1 {
+		t.Fatalf("the shared callback expected to be called once, but was %d", calls)
+	}
+	if expected, actual := "shared,other", strings.Join(keys, ","); actual != expected {
+		t.Fatalf("audited keys expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWithTimeBudget(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithTimeBudget(25*time.Millisecond))
+
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	writer.SetClock(w, func() time.Time {
+		return now
+	})
+
+	// each value takes 10ms.
+	f := func(n int) writer.ValueFunc {
+		return func(w io.Writer) error {
+			now = now.Add(10 * time.Millisecond)
+			_, err := fmt.Fprint(w, n)
+			return err
+		}
+	}
+
+	root := struct {
+		A, B, C, D, E *writer.Value
+	}{
+		A: w.MustNewValue("a", f(1)).MarkSkippable(),
+		B: w.MustNewValue("b", f(2)),
+		C: w.MustNewValue("c", f(3)).MarkSkippable(),
+		D: w.MustNewValue("d", f(4)).MarkSkippable(),
+		E: w.MustNewValue("e", f(5)),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	// the budget is exhausted after C, but E is not skippable.
+	if expected, actual := `{"A":1,"B":2,"C":3,"D":null,"E":5}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+	if !json.Valid(buf.Bytes()) {
+		t.Errorf("invalid JSON: %s", buf.String())
+	}
+}
+
+func TestWithContextCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := writer.New(new(bytes.Buffer), writer.WithContext(ctx))
+
+	var called []string
+	f := func(key string) writer.ValueFuncCtx {
+		return func(ctx context.Context, w io.Writer) error {
+			called = append(called, key)
+			cancel()
+			_, err := w.Write([]byte("1"))
+			return err
+		}
+	}
+
+	root := struct {
+		A, B *writer.Value
+	}{
+		A: w.MustNewValueCtx("a", f("a")),
+		B: w.MustNewValueCtx("b", f("b")),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); !errors.Is(err, context.Canceled) {
+		t.Fatalf("context.Canceled expected, but was %v", err)
+	}
+	if expected, actual := `["a"]`, mustMarshal(t, called); actual != expected {
+		t.Errorf("called expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWithNonce(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithNonce())
+
+	other := writer.New(ioutil.Discard)
+
+	root := struct {
+		Value     *writer.Value
+		Genuine   string
+		Forged    string
+		OtherKind *writer.Value
+	}{
+		Value: w.MustNewValue("value", func(w io.Writer) error {
+			_, err := w.Write([]byte("1"))
+			return err
+		}),
+		// user data starting with the prefix, e.g. copied from an earlier output.
+		Genuine:   writer.Sentinel() + "value",
+		Forged:    writer.Sentinel() + "unknown",
+		OtherKind: other.MustNewValue("value", func(w io.Writer) error { return nil }),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	p := writer.SentinelJSON()
+	expected := `{"Value":1,"Genuine":"` + p + `value","Forged":"` + p + `unknown","OtherKind":"` + p + `value"}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+
+	// the same data is taken as placeholders without nonce.
+	w = writer.New(new(bytes.Buffer))
+	root.Value = w.MustNewValue("value", func(w io.Writer) error { return nil })
+	if err := json.NewEncoder(w).Encode(&root); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestWithMarker(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithMarker("@@jps:"))
+
+	root := struct {
+		Value   *writer.Value
+		Default string
+	}{
+		Value: w.MustNewValue(`key"`, func(w io.Writer) error {
+			_, err := w.Write([]byte("1"))
+			return err
+		}),
+		// the default marker is nothing special.
+		Default: writer.Sentinel() + "unknown",
+	}
+
+	b, err := root.Value.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := `"@@jps:key\""`, string(b); actual != expected {
+		t.Errorf("MarshalJSON expected:%s, but was %s", expected, actual)
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"Value":1,"Default":"`+writer.SentinelJSON()+`unknown"}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWithMarkerEmpty(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("panic expected")
+		}
+	}()
+
+	writer.WithMarker("")
+}
+
+func TestWithIndent(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithIndent(">", "  "))
+
+	type Child struct {
+		Name  string
+		Array *writer.Value
+	}
+
+	root := struct {
+		Object   *writer.Value
+		Children []*Child
+	}{
+		Object: w.MustNewValue("object", func(w io.Writer) error {
+			_, err := w.Write([]byte(`{"A":1,"B":[true,false]}`))
+			return err
+		}),
+		Children: []*Child{
+			{
+				Name: "child",
+				Array: w.MustNewArrayValue("array", func(w writer.ElementWriter) error {
+					return w.WriteElement(map[string]int{"C": 2})
+				}),
+			},
+		},
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent(">", "  ")
+	if err := enc.Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	// indented as if the whole document were encoded without streaming.
+	if expected, actual := `{
+>  "Object": {
+>    "A": 1,
+>    "B": [
+>      true,
+>      false
+>    ]
+>  },
+>  "Children": [
+>    {
+>      "Name": "child",
+>      "Array": [
+>        {
+>          "C": 2
+>        }
+>      ]
+>    }
+>  ]
+>}
+`, buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWithIndentStreaming(t *testing.T) {
+	out := new(flushRecorder)
+	w := writer.New(out, writer.WithIndent("", "  "), writer.WithAutoFlush())
+
+	v := w.MustNewArrayValue("array", func(ew writer.ElementWriter) error {
+		if err := ew.WriteElement(map[string]interface{}{"A": []int{}, "B": "x , y"}); err != nil {
+			return err
+		}
+
+		// the first element has been written before the callback returns.
+		if expected, actual := "[\n  {\n    \"A\": [],\n    \"B\": \"x , y\"\n  }", out.String(); actual != expected {
+			return fmt.Errorf("written expected:%s, but was %s", expected, actual)
+		}
+
+		return ew.WriteElement(struct{}{})
+	})
+
+	if err := w.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "[\n  {\n    \"A\": [],\n    \"B\": \"x , y\"\n  },\n  {}\n]\n", out.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+	if len(out.flushed) < 2 {
+		t.Fatalf("flushed for each element expected, but was %q", out.flushed)
+	}
+}
+
+func TestWithPrettyValuesLikeIndent(t *testing.T) {
+	for _, src := range []string{
+		`1`,
+		`"a\"[,]:{}"`,
+		`{ "a" : [ 1 , { } , [ ] , null ] , "b" : { "c" : "d" } }`,
+		`[[[]],{"x":{"y":[true,false]}}]`,
+	} {
+		buf := new(bytes.Buffer)
+		w := writer.New(buf, writer.WithPrettyValues("\t"))
+
+		// written in pieces as small as a byte.
+		v := w.MustNewValue("value", func(w io.Writer) error {
+			for i := 0; i < len(src); i++ {
+				if _, err := w.Write([]byte{src[i]}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err := w.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+
+		indented := new(bytes.Buffer)
+		if err := json.Indent(indented, []byte(src), "", "\t"); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := indented.String()+"\n", buf.String(); actual != expected {
+			t.Errorf("result expected:%s, but was %s", expected, actual)
+		}
+	}
+}
+
+func TestWithAutoFlush(t *testing.T) {
+	out := new(flushRecorder)
+	w := writer.New(out, writer.WithAutoFlush())
+
+	root := struct {
+		Array *writer.Value
+		Value *writer.Value
+	}{
+		Array: w.MustNewArrayValue("array", func(w writer.ElementWriter) error {
+			for i := 1; i <= 2; i++ {
+				if err := w.WriteElement(i); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+		Value: w.MustNewValue("value", func(w io.Writer) error {
+			_, err := w.Write([]byte(`"v"`))
+			return err
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `["{\"Array\":[1","{\"Array\":[1,2","{\"Array\":[1,2]","{\"Array\":[1,2],\"Value\":\"v\""]`
+	if actual := mustMarshal(t, out.flushed); actual != expected {
+		t.Fatalf("flushed expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWithMaxMarkerBuffer(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithMaxMarkerBuffer(20))
+
+	f := func(w io.Writer) error {
+		_, err := w.Write([]byte("1"))
+		return err
+	}
+
+	root := struct {
+		Short *writer.Value
+		Long  *writer.Value
+	}{
+		Short: w.MustNewValue("short", f),
+		Long:  w.MustNewValue(strings.Repeat("x", 20), f),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	// the placeholder of the long key is too long to be buffered.
+	expected := `{"Short":1,"Long":"` + writer.SentinelJSON() + strings.Repeat("x", 20) + `"}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWithValueHook(t *testing.T) {
+	var events []string
+	hook := func(key string) func(err error) {
+		events = append(events, "start "+key)
+		return func(err error) {
+			events = append(events, fmt.Sprintf("end %s %v", key, err))
+		}
+	}
+
+	w := writer.New(new(bytes.Buffer), writer.WithValueHook(hook))
+
+	root := struct {
+		Value  *writer.Value
+		Array  *writer.Value
+		Failed *writer.Value
+	}{
+		Value: w.MustNewValue("value", func(w io.Writer) error {
+			_, err := w.Write([]byte("1"))
+			return err
+		}),
+		Array: w.MustNewArrayValue("array", func(w writer.ElementWriter) error {
+			return w.WriteElement(2)
+		}),
+		Failed: w.MustNewValue("failed", func(w io.Writer) error {
+			return errors.New("failure")
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err == nil {
+		t.Fatal("error expected")
+	}
+
+	expected := `start value|end value <nil>|start array|end array <nil>|start failed|end failed streaming value "failed": failure`
+	if actual := strings.Join(events, "|"); actual != expected {
+		t.Fatalf("events expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWithValueHookCtx(t *testing.T) {
+	var events []string
+	hook := func(name string) func(ctx context.Context, key string) func(err error) {
+		return func(ctx context.Context, key string) func(err error) {
+			events = append(events, fmt.Sprintf("start %s %s %v", name, key, ctx.Value(ctxKey{})))
+			return func(err error) {
+				events = append(events, "end "+name)
+			}
+		}
+	}
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+	w := writer.New(new(bytes.Buffer), writer.WithContext(ctx), writer.WithValueHookCtx(hook("a")), writer.WithValueHookCtx(hook("b")))
+
+	v := w.MustNewValue("value", func(w io.Writer) error {
+		_, err := w.Write([]byte("1"))
+		return err
+	})
+	if err := w.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+
+	// the hooks are nested in order.
+	expected := `start a value request|start b value request|end b|end a`
+	if actual := strings.Join(events, "|"); actual != expected {
+		t.Fatalf("events expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWithEscapeHTML(t *testing.T) {
+	for _, test := range []struct {
+		on       bool
+		expected string
+	}{
+		{on: true, expected: `{"Text":"\u003cb\u003e","Items":["\u003ci\u003e"],"Object":{"\u0026":"\u003e"}}` + "\n"},
+		{on: false, expected: `{"Text":"<b>","Items":["<i>"],"Object":{"&":">"}}` + "\n"},
+	} {
+		buf := new(bytes.Buffer)
+		w := writer.New(buf, writer.WithEscapeHTML(test.on))
+
+		root := struct {
+			Text   string
+			Items  *writer.Value
+			Object *writer.Value
+		}{
+			Text: "<b>",
+			Items: w.MustNewArrayValue("items", func(w writer.ElementWriter) error {
+				return w.WriteElement("<i>")
+			}),
+			Object: w.MustNewObjectValue("object", func(w writer.ObjectWriter) error {
+				return w.WriteMember("&", ">")
+			}),
+		}
+
+		if err := w.Encode(&root); err != nil {
+			t.Fatal(err)
+		}
+
+		if actual := buf.String(); actual != test.expected {
+			t.Errorf("result expected:%s, but was %s", test.expected, actual)
+		}
+	}
+}
+
+func TestWithEscapeHTMLValues(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithEscapeHTML(false))
+
+	root := struct {
+		Lazy     *writer.Value
+		Fallible *writer.Value
+		Markdown *writer.Value
+		Template *writer.Value
+		Merged   *writer.Value
+	}{
+		Lazy: w.MustNewLazyStructValue("lazy", func() (interface{}, error) {
+			return map[string]string{"a": "<b>"}, nil
+		}),
+		Fallible: w.MustNewFallibleValue("fallible", func(w io.Writer) error {
+			return errors.New("a < b")
+		}),
+		Markdown: w.MustNewMarkdownHTMLValue("markdown", []byte("x & y"), stubRenderer{}),
+		Template: w.MustNewBoundTemplateValue("template", []byte(`{"t":"{{$.t}}"}`), map[string]string{"t": "<t>"}),
+		Merged:   w.MustNewMergedObjectValue("merged", json.RawMessage(`{"m":"&"}`)),
+	}
+
+	if err := w.Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Lazy":{"a":"<b>"},"Fallible":{"error":"a < b"},"Markdown":"<p>x & y</p>\n",` +
+		`"Template":{"t":"<t>"},"Merged":{"m":"&"}}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWithUnsafeNoLock(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithUnsafeNoLock())
+
+	var vs []*writer.Value
+	for i := 0; i < 3; i++ {
+		i := i
+		vs = append(vs, w.MustNewValue(fmt.Sprint(i), func(w io.Writer) error {
+			_, err := fmt.Fprint(w, i)
+			return err
+		}))
+	}
+	vs[1].Cancel()
+
+	if err := json.NewEncoder(w).Encode(vs); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "[0,null,2]\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func benchmarkNewValue(b *testing.B, opts ...writer.Option) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = fmt.Sprint(i)
+	}
+	f := func(w io.Writer) error { return nil }
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w := writer.New(ioutil.Discard, opts...)
+		for _, key := range keys {
+			w.MustNewValue(key, f)
+		}
+	}
+}
+
+func BenchmarkNewValue(b *testing.B) {
+	benchmarkNewValue(b)
+}
+
+func BenchmarkNewValueNoLock(b *testing.B) {
+	benchmarkNewValue(b, writer.WithUnsafeNoLock())
+}
+
+func TestWithExpectedValues(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithExpectedValues(1))
+
+	// more values than expected.
+	var vs []*writer.Value
+	for i := 0; i < 3; i++ {
+		vs = append(vs, w.MustNewBytesValue(fmt.Sprint(i), []byte(fmt.Sprint(i))))
+	}
+
+	if err := json.NewEncoder(w).Encode(vs); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "[0,1,2]\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func benchmarkRegister(b *testing.B, opts ...writer.Option) {
+	keys := make([]string, 100000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("$.Child[%d].Values", i)
+	}
+	f := func(w io.Writer) error { return nil }
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w := writer.New(ioutil.Discard, opts...)
+		for _, key := range keys {
+			w.MustNewValue(key, f)
+		}
+	}
+}
+
+func BenchmarkRegister100k(b *testing.B) {
+	benchmarkRegister(b)
+}
+
+func BenchmarkRegister100kExpected(b *testing.B) {
+	benchmarkRegister(b, writer.WithExpectedValues(100000))
+}
+
+func TestWithUnknownKeyPolicy(t *testing.T) {
+	other := writer.New(ioutil.Discard)
+	unknown := other.MustNewValue("unknown", func(w io.Writer) error { return nil })
+
+	for _, c := range []struct {
+		policy   writer.UnknownKeyPolicy
+		expected string
+		err      error
+	}{
+		{writer.PolicyError, `{"a":`, writer.ErrUnknownKey},
+		{writer.PolicyNull, `{"a":null,"b":1}` + "\n", nil},
+		{writer.PolicySkip, `{"a":,"b":1}` + "\n", nil},
+	} {
+		buf := new(bytes.Buffer)
+		w := writer.New(buf, writer.WithUnknownKeyPolicy(c.policy))
+
+		root := struct {
+			A *writer.Value `json:"a"`
+			B int           `json:"b"`
+		}{A: unknown, B: 1}
+
+		if err := json.NewEncoder(w).Encode(&root); !errors.Is(err, c.err) {
+			t.Fatalf("policy %d: error expected %v, but was %v", c.policy, c.err, err)
+		}
+		if actual := buf.String(); actual != c.expected {
+			t.Fatalf("policy %d: result expected:%s, but was %s", c.policy, c.expected, actual)
+		}
+	}
+}
+
+func TestWithCompactKeys(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	var keys []string
+	w := writer.New(buf, writer.WithCompactKeys(), writer.WithAuditLogger(func(key string) {
+		keys = append(keys, key)
+	}))
+
+	var vs []*writer.Value
+	for i := 0; i < 3; i++ {
+		i := i
+		vs = append(vs, w.MustNewValue(fmt.Sprintf("$.Child[%d].ArrayValues", i), func(w io.Writer) error {
+			_, err := fmt.Fprint(w, i)
+			return err
+		}))
+	}
+
+	jsn, err := json.Marshal(vs[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := `"`+writer.SentinelJSON()+`2"`, string(jsn); actual != expected {
+		t.Fatalf("placeholder expected:%s, but was %s", expected, actual)
+	}
+
+	if err := json.NewEncoder(w).Encode(vs); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := "[0,1,2]\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+	if expected := []string{"$.Child[0].ArrayValues", "$.Child[1].ArrayValues", "$.Child[2].ArrayValues"}; !reflect.DeepEqual(keys, expected) {
+		t.Fatalf("keys expected:%v, but was %v", expected, keys)
+	}
+
+	// standalone values are looked up by the key.
+	buf.Reset()
+	if err := w.WriteValue("$.Child[1].ArrayValues", buf); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "1", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
@@ -0,0 +1,48 @@
+package writer
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrOutputClosed is matched by errors.Is for the errors returned by the destination given to New or Reset,
+// e.g. when the client has disconnected, so that servers can tell them from the errors of callbacks.
+// The original error is still available by errors.Is and errors.As.
+var ErrOutputClosed = errors.New("output closed")
+
+// outputError is an error returned by the destination.
+type outputError struct {
+	err error
+}
+
+func (e *outputError) Error() string {
+	return "writing output: " + e.err.Error()
+}
+
+func (e *outputError) Unwrap() error {
+	return e.err
+}
+
+func (e *outputError) Is(target error) bool {
+	return target == ErrOutputClosed
+}
+
+// outputWriter marks the errors returned by w as outputError.
+type outputWriter struct {
+	w io.Writer
+}
+
+func (ow *outputWriter) Write(p []byte) (int, error) {
+	n, err := ow.w.Write(p)
+	if err != nil {
+		return n, &outputError{err: err}
+	}
+	return n, nil
+}
+
+func (ow *outputWriter) Flush() error {
+	if err := flush(ow.w); err != nil {
+		return &outputError{err: err}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package writer_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+var errDisconnected = errors.New("disconnected")
+
+// disconnectingWriter fails once n bytes have been written.
+type disconnectingWriter struct {
+	n int
+}
+
+func (dw *disconnectingWriter) Write(p []byte) (int, error) {
+	if len(p) > dw.n {
+		n := dw.n
+		dw.n = 0
+		return n, errDisconnected
+	}
+	dw.n -= len(p)
+	return len(p), nil
+}
+
+func TestOutputClosed(t *testing.T) {
+	w := writer.New(&disconnectingWriter{n: 10})
+
+	v := w.MustNewArrayValue("items", func(w writer.ElementWriter) error {
+		for i := 0; i < 100; i++ {
+			if err := w.WriteElement(i); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	err := json.NewEncoder(w).Encode(map[string]interface{}{"items": v})
+	if !errors.Is(err, writer.ErrOutputClosed) {
+		t.Fatalf("ErrOutputClosed expected, but was %v", err)
+	}
+	if !errors.Is(err, errDisconnected) {
+		t.Fatalf("%v expected, but was %v", errDisconnected, err)
+	}
+
+	// errors of callbacks are told from it.
+	errCallback := errors.New("callback failed")
+	w = writer.New(ioutil.Discard)
+	v = w.MustNewValue("failed", func(w io.Writer) error {
+		return errCallback
+	})
+
+	err = json.NewEncoder(w).Encode(v)
+	if !errors.Is(err, errCallback) {
+		t.Fatalf("%v expected, but was %v", errCallback, err)
+	}
+	if errors.Is(err, writer.ErrOutputClosed) {
+		t.Fatalf("ErrOutputClosed not expected, but was %v", err)
+	}
+}
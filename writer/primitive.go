@@ -0,0 +1,60 @@
+package writer
+
+import (
+	"math"
+	"strconv"
+	"unicode/utf8"
+)
+
+// appendPrimitive appends the JSON encoding of e to b in the same way as json.Marshal,
+// if e is one of the common primitive types. It returns false for the other types,
+// and for the values which need special care, e.g. NaN and strings to be escaped.
+func appendPrimitive(b []byte, e interface{}) ([]byte, bool) {
+	switch v := e.(type) {
+	case int:
+		return strconv.AppendInt(b, int64(v), 10), true
+	case int64:
+		return strconv.AppendInt(b, v, 10), true
+	case bool:
+		return strconv.AppendBool(b, v), true
+	case float64:
+		return appendFloat(b, v)
+	case string:
+		return appendString(b, v)
+	}
+	return b, false
+}
+
+// appendFloat formats f as encoding/json does.
+func appendFloat(b []byte, f float64) ([]byte, bool) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return b, false
+	}
+
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	b = strconv.AppendFloat(b, f, format, -1, 64)
+	if format == 'e' {
+		// clean up e-09 to e-9
+		if n := len(b); n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	return b, true
+}
+
+// appendString quotes s if it needs no escaping.
+func appendString(b []byte, s string) ([]byte, bool) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c >= utf8.RuneSelf || c == '"' || c == '\\' || c == '<' || c == '>' || c == '&' {
+			return b, false
+		}
+	}
+	b = append(b, '"')
+	b = append(b, s...)
+	return append(b, '"'), true
+}
@@ -0,0 +1,81 @@
+package writer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+func TestWriteElementPrimitives(t *testing.T) {
+	es := []interface{}{
+		0, -1, math.MaxInt64, int64(math.MinInt64), true, false,
+		0.0, -0.0, 1.5, 1e-7, 1e20, 1e21, -1.25e-10, math.MaxFloat64, math.SmallestNonzeroFloat64,
+		"", "plain", `"quoted"`, `back\slash`, "<&>", "日本語", " ", "\x01", "\xff",
+	}
+
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	v := w.MustNewArrayValue("primitives", func(w writer.ElementWriter) error {
+		for _, e := range es {
+			if err := w.WriteElement(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := json.Marshal(es)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual := buf.String(); actual != string(expected)+"\n" {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+
+	// unsupported values fail as json.Marshal does.
+	w = writer.New(ioutil.Discard)
+	v = w.MustNewArrayValue("nan", func(w writer.ElementWriter) error {
+		return w.WriteElement(math.NaN())
+	})
+	if err := json.NewEncoder(w).Encode(v); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+// number is not a primitive type for the fast path.
+type number int
+
+func benchmarkWriteElement(b *testing.B, e interface{}) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w := writer.New(ioutil.Discard)
+		v := w.MustNewArrayValue("numbers", func(w writer.ElementWriter) error {
+			for j := 0; j < 10000; j++ {
+				if err := w.WriteElement(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteElementPrimitive(b *testing.B) {
+	benchmarkWriteElement(b, 12345)
+}
+
+func BenchmarkWriteElementGeneric(b *testing.B) {
+	benchmarkWriteElement(b, number(12345))
+}
@@ -0,0 +1,109 @@
+package writer
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// rateLimitWriter caps the byte rate written to w with a token bucket.
+type rateLimitWriter struct {
+	w        io.Writer
+	ctx      context.Context
+	now      func() time.Time
+	rate     float64 // tokens(bytes) per second
+	burst    int
+	tokens   float64
+	last     time.Time
+	drain    chan struct{} // signaled by Drain
+	draining bool          // throttling is suspended until the next safe boundary
+}
+
+func newRateLimitWriter(ctx context.Context, w io.Writer, now func() time.Time, bytesPerSec int, burst int) *rateLimitWriter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimitWriter{
+		w:      w,
+		ctx:    ctx,
+		now:    now,
+		rate:   float64(bytesPerSec),
+		burst:  burst,
+		tokens: float64(burst),
+		drain:  make(chan struct{}, 1),
+	}
+}
+
+func (rw *rateLimitWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		chunk := len(p)
+		if chunk > rw.burst {
+			chunk = rw.burst
+		}
+
+		if err := rw.wait(chunk); err != nil {
+			return n, err
+		}
+
+		nn, err := rw.w.Write(p[:chunk])
+		n += nn
+		if err != nil {
+			return n, err
+		}
+		p = p[chunk:]
+	}
+	return n, nil
+}
+
+func (rw *rateLimitWriter) Flush() error {
+	return flush(rw.w)
+}
+
+// wait blocks until n tokens are available and consumes them.
+// It returns early without error when Drain is called, so that the output reaches a safe boundary promptly,
+// and returns ctx.Err() when ctx is done.
+func (rw *rateLimitWriter) wait(n int) error {
+	now := rw.now()
+	if !rw.last.IsZero() {
+		rw.tokens += now.Sub(rw.last).Seconds() * rw.rate
+		if rw.tokens > float64(rw.burst) {
+			rw.tokens = float64(rw.burst)
+		}
+	}
+	rw.last = now
+
+	rw.tokens -= float64(n)
+	if rw.tokens >= 0 {
+		return nil
+	}
+	if rw.draining {
+		// the bytes written while draining don't delay the later ones.
+		rw.tokens = 0
+		return nil
+	}
+
+	d := time.Duration(-rw.tokens / rw.rate * float64(time.Second))
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		rw.last = now.Add(d)
+	case <-rw.drain:
+		rw.draining = true
+		rw.last = rw.now()
+	case <-rw.ctx.Done():
+		return rw.ctx.Err()
+	}
+	rw.tokens = 0
+	return nil
+}
+
+// boundary resumes throttling suspended by Drain.
+func (rw *rateLimitWriter) boundary() {
+	select {
+	case <-rw.drain:
+	default:
+	}
+	rw.draining = false
+}
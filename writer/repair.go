@@ -0,0 +1,71 @@
+package writer
+
+import (
+	"io"
+	"strings"
+)
+
+// repairWriter tracks the structure of a value written through it, to close what is left open.
+type repairWriter struct {
+	w    io.Writer
+	s    scanner
+	last byte // the last significant byte outside of strings
+}
+
+func (rw *repairWriter) Write(p []byte) (int, error) {
+	n, err := rw.w.Write(p)
+	for _, b := range p[:n] {
+		onString := rw.s.onString
+		_ = rw.s.step(b)
+		if !onString && b != ' ' && b != '\t' && b != '\n' && b != '\r' {
+			rw.last = b
+		}
+	}
+	return n, err
+}
+
+func (rw *repairWriter) Flush() error {
+	return flush(rw.w)
+}
+
+// closing returns the bytes needed to make the written value complete on a best-effort basis.
+func (rw *repairWriter) closing() string {
+	var sb strings.Builder
+
+	switch {
+	case rw.s.onString:
+		if rw.s.escaping {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte('"')
+		if rw.s.onKey {
+			sb.WriteString(":null")
+		}
+	case rw.last == 0, rw.last == ':':
+		// nothing has been written, or a member lacks its value.
+		sb.WriteString("null")
+	case rw.last == ',':
+		if rw.s.inObject() {
+			sb.WriteString(`"":null`)
+		} else {
+			sb.WriteString("null")
+		}
+	case rw.last == '{' || rw.last == '[':
+		// empty container is complete once closed.
+	default:
+		if rw.s.inObject() && rw.s.top().expectKey && rw.last == '"' {
+			// a key without value
+			sb.WriteString(":null")
+		}
+	}
+
+	for i := len(rw.s.stack) - 1; i >= 0; i-- {
+		if rw.s.stack[i].object {
+			sb.WriteByte('}')
+		} else {
+			sb.WriteByte(']')
+		}
+	}
+
+	return sb.String()
+}
@@ -0,0 +1,64 @@
+package writer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+func TestWithRepair(t *testing.T) {
+	for _, test := range []struct {
+		output   string
+		expected string
+		repaired bool
+	}{
+		{output: `[1,2`, expected: `[1,2]`, repaired: true},
+		{output: `[1,2]`, expected: `[1,2]`},
+		{output: `{"a":[{"b":"x`, expected: `{"a":[{"b":"x"}]}`, repaired: true},
+		{output: `{"a":"\\`, expected: `{"a":"\\"}`, repaired: true},
+		{output: `{"a":"\`, expected: `{"a":"\\"}`, repaired: true},
+		{output: `{"a":`, expected: `{"a":null}`, repaired: true},
+		{output: `{"a":1,`, expected: `{"a":1,"":null}`, repaired: true},
+		{output: `{"a`, expected: `{"a":null}`, repaired: true},
+		{output: `{"a"`, expected: `{"a":null}`, repaired: true},
+		{output: `[1, `, expected: `[1, null]`, repaired: true},
+		{output: `[{}, [`, expected: `[{}, []]`, repaired: true},
+		{output: `"]}"`, expected: `"]}"`},
+		{output: ``, expected: `null`, repaired: true},
+		{output: ` `, expected: ` null`, repaired: true},
+	} {
+		buf := new(bytes.Buffer)
+
+		var logs []string
+		w := writer.New(buf, writer.WithRepair(func(key string, appended string) {
+			logs = append(logs, key+":"+appended)
+		}))
+
+		output := test.output
+		root := struct {
+			Value *writer.Value
+		}{
+			Value: w.MustNewValue("value", func(w io.Writer) error {
+				_, err := w.Write([]byte(output))
+				return err
+			}),
+		}
+
+		if err := json.NewEncoder(w).Encode(&root); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := `{"Value":`+test.expected+"}\n", buf.String(); actual != expected {
+			t.Errorf("result expected:%s, but was %s", expected, actual)
+		}
+		if !json.Valid(buf.Bytes()) {
+			t.Errorf("result must be valid: %s", buf)
+		}
+		if repaired := len(logs) > 0; repaired != test.repaired {
+			t.Errorf("%s: repaired expected:%v, but was %v", test.output, test.repaired, logs)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package writer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrDuplicateObjectKey is returned when an object has duplicate keys in validation mode.
+var ErrDuplicateObjectKey = errors.New("duplicate object key")
+
+// ErrMaxNestingDepthExceeded is returned when the document is nested deeper than the limit.
+var ErrMaxNestingDepthExceeded = errors.New("max nesting depth exceeded")
+
+// frame is a container being scanned.
+type frame struct {
+	object    bool
+	expectKey bool                // an object key comes next
+	keys      map[string]struct{} // keys seen in the object, only when checking duplicates
+}
+
+// scanner tracks the structure of JSON passed through byte by byte.
+type scanner struct {
+	stack    []frame
+	onString bool
+	escaping bool
+	onKey    bool   // the current string is an object key
+	keyBuf   []byte // the current key, only when checking duplicates
+
+	// validations
+	checkDuplicateKeys bool
+	maxDepth           int
+}
+
+// step scans b.
+func (s *scanner) step(b byte) error {
+	if s.onString {
+		if s.onKey && s.checkDuplicateKeys {
+			s.keyBuf = append(s.keyBuf, b)
+		}
+
+		if s.escaping {
+			s.escaping = false
+		} else if b == '\\' {
+			s.escaping = true
+		} else if b == '"' {
+			s.onString = false
+			if s.onKey && s.checkDuplicateKeys {
+				return s.addKey()
+			}
+		}
+		return nil
+	}
+
+	switch b {
+	case '"':
+		s.onString = true
+		s.escaping = false
+		s.onKey = s.inObject() && s.top().expectKey
+		if s.onKey && s.checkDuplicateKeys {
+			s.keyBuf = append(s.keyBuf[:0], b)
+		}
+	case '{', '[':
+		if s.maxDepth > 0 && len(s.stack) >= s.maxDepth {
+			return fmt.Errorf("%w: %d", ErrMaxNestingDepthExceeded, s.maxDepth)
+		}
+	}
+
+	switch b {
+	case '{':
+		f := frame{object: true, expectKey: true}
+		if s.checkDuplicateKeys {
+			f.keys = map[string]struct{}{}
+		}
+		s.stack = append(s.stack, f)
+	case '[':
+		s.stack = append(s.stack, frame{})
+	case '}', ']':
+		if len(s.stack) > 0 {
+			s.stack = s.stack[:len(s.stack)-1]
+		}
+	case ':':
+		if s.inObject() {
+			s.top().expectKey = false
+		}
+	case ',':
+		if s.inObject() {
+			s.top().expectKey = true
+		}
+	}
+
+	return nil
+}
+
+func (s *scanner) top() *frame {
+	return &s.stack[len(s.stack)-1]
+}
+
+func (s *scanner) inObject() bool {
+	return len(s.stack) > 0 && s.top().object
+}
+
+// addKey adds the key in keyBuf to the current object, and returns error if it is duplicate.
+func (s *scanner) addKey() error {
+	// keys are compared after unescaping, since the same key can be escaped differently.
+	var key string
+	if err := json.Unmarshal(s.keyBuf, &key); err != nil {
+		return err
+	}
+
+	keys := s.top().keys
+	if _, ok := keys[key]; ok {
+		return fmt.Errorf("%w: %q", ErrDuplicateObjectKey, key)
+	}
+	keys[key] = struct{}{}
+
+	return nil
+}
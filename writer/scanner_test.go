@@ -0,0 +1,85 @@
+package writer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+func TestWithDuplicateKeyCheck(t *testing.T) {
+	for _, test := range []struct {
+		doc       string
+		duplicate bool
+	}{
+		{doc: `{"a":1,"b":{"a":2,"b":[{"a":3},{"a":4}]},"c":"a"}`},
+		{doc: `{"a":1,"b":2,"a":3}`, duplicate: true},
+		{doc: `[{"x":{"a":1,"a":2}}]`, duplicate: true},
+		{doc: `{"a":{"b":1},"b":{"b":2},"a":3}`, duplicate: true},
+		{doc: `{"a":{},"b":{"a":[]},"c":["a","a"]}`},
+	} {
+		w := writer.New(new(bytes.Buffer), writer.WithDuplicateKeyCheck())
+
+		_, err := w.Write([]byte(test.doc))
+		if test.duplicate {
+			if !errors.Is(err, writer.ErrDuplicateObjectKey) {
+				t.Errorf("%s: ErrDuplicateObjectKey expected, but was %v", test.doc, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error %v", test.doc, err)
+		}
+	}
+}
+
+// duplicateMap is a buggy Marshaler which produces a duplicate key.
+type duplicateMap map[string]int
+
+func (m duplicateMap) MarshalJSON() ([]byte, error) {
+	return []byte(`{"id":1,"id":2}`), nil
+}
+
+func TestWithDuplicateKeyCheckEncoder(t *testing.T) {
+	w := writer.New(new(bytes.Buffer), writer.WithDuplicateKeyCheck())
+
+	root := struct {
+		Value *writer.Value
+		Map   duplicateMap
+	}{
+		Value: w.MustNewValue("value", func(w io.Writer) error {
+			_, err := w.Write([]byte(`{"id":1}`))
+			return err
+		}),
+		Map: duplicateMap{},
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); !errors.Is(err, writer.ErrDuplicateObjectKey) {
+		t.Fatalf("ErrDuplicateObjectKey expected, but was %v", err)
+	}
+}
+
+func TestWithMaxNestingDepth(t *testing.T) {
+	for _, test := range []struct {
+		doc      string
+		exceeded bool
+	}{
+		{doc: `{"a":[{"b":"[[[[{{{{"}]}`},
+		{doc: `[[[]],[[]],{"a":[]}]`},
+		{doc: `{"a":[{"b":[]}]}`, exceeded: true},
+		{doc: strings.Repeat("[", 1000) + strings.Repeat("]", 1000), exceeded: true},
+	} {
+		w := writer.New(new(bytes.Buffer), writer.WithMaxNestingDepth(3))
+
+		_, err := w.Write([]byte(test.doc))
+		if test.exceeded {
+			if !errors.Is(err, writer.ErrMaxNestingDepthExceeded) {
+				t.Errorf("%s: ErrMaxNestingDepthExceeded expected, but was %v", test.doc, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error %v", test.doc, err)
+		}
+	}
+}
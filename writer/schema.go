@@ -0,0 +1,32 @@
+package writer
+
+import "fmt"
+
+// SchemaValidator validates a whole JSON document, typically against a JSON Schema.
+// doc is the complete document as it would be written, so an implementation typically unmarshals it
+// and passes the result to a schema compiled once beforehand, returning the violations as the error.
+type SchemaValidator interface {
+	// Validate returns error describing violations if doc is invalid.
+	Validate(doc []byte) error
+}
+
+// Close finishes the output.
+// When WithSchema is given, it validates the buffered document and writes it to the destination only when it is valid.
+// Otherwise it does nothing.
+func (w *Writer) Close() error {
+	if w.schema == nil {
+		return nil
+	}
+
+	defer w.doc.Reset()
+
+	if err := w.schema.Validate(w.doc.Bytes()); err != nil {
+		return fmt.Errorf("schema validation failed: %w", err)
+	}
+
+	if _, err := w.out.Write(w.doc.Bytes()); err != nil {
+		return err
+	}
+
+	return nil
+}
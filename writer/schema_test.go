@@ -0,0 +1,90 @@
+package writer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+// requiredValidator is a SchemaValidator which checks required properties of array items.
+type requiredValidator struct {
+	array    string
+	required []string
+}
+
+func (rv *requiredValidator) Validate(doc []byte) error {
+	var m map[string][]map[string]interface{}
+	if err := json.Unmarshal(doc, &m); err != nil {
+		return err
+	}
+
+	var violations []string
+	for i, item := range m[rv.array] {
+		for _, r := range rv.required {
+			if _, ok := item[r]; !ok {
+				violations = append(violations, fmt.Sprintf("/%s/%d: missing required property %q", rv.array, i, r))
+			}
+		}
+	}
+	if len(violations) > 0 {
+		return fmt.Errorf("%s", strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+func encodeItems(t *testing.T, out io.Writer, items ...interface{}) error {
+	t.Helper()
+
+	w := writer.New(out, writer.WithSchema(&requiredValidator{array: "Items", required: []string{"id"}}))
+
+	root := struct {
+		Items *writer.Value
+	}{
+		Items: w.MustNewArrayValue("items", func(w writer.ElementWriter) error {
+			for _, item := range items {
+				if err := w.WriteElement(item); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	return w.Close()
+}
+
+func TestWithSchema(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	if err := encodeItems(t, buf, map[string]int{"id": 1}, map[string]int{"id": 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"Items":[{"id":1},{"id":2}]}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWithSchemaViolation(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	err := encodeItems(t, buf, map[string]int{"id": 1}, map[string]int{"ID": 2})
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	if expected := `/Items/1: missing required property "id"`; !strings.Contains(err.Error(), expected) {
+		t.Errorf("error must contain %s, but was %v", expected, err)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("invalid document must not be written, but was %s", buf)
+	}
+}
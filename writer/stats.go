@@ -0,0 +1,35 @@
+package writer
+
+import "io"
+
+// countingWriter counts the bytes written to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
+
+func (cw *countingWriter) Flush() error {
+	return flush(cw.w)
+}
+
+// BytesByKey returns the number of bytes written in place of the placeholders of each key, e.g. to find large values.
+// The bytes of the structure around the elements and members of array and object values are included,
+// and so are the bytes of the nested values, which are counted for their own keys as well.
+// Keys whose placeholders are reached multiple times have the sum, and canceled values are not counted.
+// The values of the children created by Sub are counted by the children.
+func (w *Writer) BytesByKey() map[string]int64 {
+	w.lock()
+	defer w.unlock()
+
+	m := make(map[string]int64, len(w.bytesByKey))
+	for key, n := range w.bytesByKey {
+		m[key] = n
+	}
+	return m
+}
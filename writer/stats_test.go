@@ -0,0 +1,50 @@
+package writer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+func TestBytesByKey(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	nested := w.MustNewValue("nested", func(w io.Writer) error {
+		_, err := w.Write([]byte(`"nested"`))
+		return err
+	})
+	canceled := w.MustNewValue("canceled", func(w io.Writer) error {
+		_, err := w.Write([]byte(`"canceled"`))
+		return err
+	})
+	canceled.Cancel()
+
+	root := struct {
+		Array    *writer.Value
+		Repeated []*writer.Value
+		Canceled *writer.Value
+	}{
+		Array: w.MustNewArrayValue("array", func(w writer.ElementWriter) error {
+			return w.WriteElements(1, 22, nested)
+		}),
+		Repeated: []*writer.Value{nested, nested},
+		Canceled: canceled,
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]int64{
+		"array":  int64(len(`[1,22,"nested"]`)),
+		"nested": int64(len(`"nested"`) * 3),
+	}
+	if actual := w.BytesByKey(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("bytes expected:%v, but was %v", expected, actual)
+	}
+}
@@ -0,0 +1,270 @@
+package writer
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"unicode/utf8"
+)
+
+// NewMultiReaderBase64StringValue creates a Value which describes JSON string of base64 encoded concatenation of rs.
+// The readers are read sequentially when the value is streamed.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewMultiReaderBase64StringValue(key string, rs ...io.Reader) (*Value, error) {
+	return w.newValue(key, base64StringValueFunc(io.MultiReader(rs...)))
+}
+
+// MustNewMultiReaderBase64StringValue creates a Value which describes JSON string of base64 encoded concatenation of rs.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewMultiReaderBase64StringValue(key string, rs ...io.Reader) *Value {
+	return w.mustNewValue(key, base64StringValueFunc(io.MultiReader(rs...)))
+}
+
+func base64StringValueFunc(r io.Reader) ValueFunc {
+	return func(w io.Writer) error {
+		return writeBase64String(w, func(w io.Writer) error {
+			_, err := io.Copy(w, r)
+			return err
+		})
+	}
+}
+
+// NewCompressedValue creates a Value whose JSON output of f is compressed, so that the client can decompress just it.
+// The value is written as an object like {"encoding":"gzip","data":"<base64>"},
+// where data is the base64 encoded gzip of the output of f,
+// and encoding is the flag telling the client that data must be decoded to get the original JSON value.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewCompressedValue(key string, f ValueFunc) (*Value, error) {
+	return w.newValue(key, compressedValueFunc(f))
+}
+
+// MustNewCompressedValue creates a Value whose JSON output of f is compressed.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewCompressedValue(key string, f ValueFunc) *Value {
+	return w.mustNewValue(key, compressedValueFunc(f))
+}
+
+func compressedValueFunc(f ValueFunc) ValueFunc {
+	return func(w io.Writer) error {
+		if _, err := w.Write([]byte(`{"encoding":"gzip","data":`)); err != nil {
+			return err
+		}
+
+		if err := writeBase64String(w, func(w io.Writer) error {
+			gz := gzip.NewWriter(w)
+			if err := f(gz); err != nil {
+				return err
+			}
+			return gz.Close()
+		}); err != nil {
+			return err
+		}
+
+		if _, err := w.Write([]byte(`}`)); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
+
+// writeBase64String writes the output of f to w as base64 encoded JSON string.
+// The base64 alphabet needs no escaping in JSON strings.
+func writeBase64String(w io.Writer, f func(w io.Writer) error) error {
+	if _, err := w.Write([]byte(`"`)); err != nil {
+		return err
+	}
+
+	enc := base64.NewEncoder(base64.StdEncoding, w)
+	if err := f(enc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+
+	if _, err := w.Write([]byte(`"`)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// NewHashStringValue creates a Value which describes JSON string of hex digest of the content of r hashed by h.
+// r is read in a single streaming pass when the value is streamed, and its content is not written.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewHashStringValue(key string, r io.Reader, h func() hash.Hash) (*Value, error) {
+	return w.newValue(key, hashStringValueFunc(r, h))
+}
+
+// MustNewHashStringValue creates a Value which describes JSON string of hex digest of the content of r hashed by h.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewHashStringValue(key string, r io.Reader, h func() hash.Hash) *Value {
+	return w.mustNewValue(key, hashStringValueFunc(r, h))
+}
+
+func hashStringValueFunc(r io.Reader, h func() hash.Hash) ValueFunc {
+	return func(w io.Writer) error {
+		hh := h()
+		if _, err := io.Copy(hh, r); err != nil {
+			return err
+		}
+
+		if _, err := w.Write([]byte(`"` + hex.EncodeToString(hh.Sum(nil)) + `"`)); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
+
+// MarkdownRenderer renders markdown to HTML.
+// Render writes the HTML of source to w as it goes, e.g. by calling Convert of a goldmark.Markdown,
+// so that the HTML is escaped and streamed without being held as a whole.
+type MarkdownRenderer interface {
+	Render(w io.Writer, source []byte) error
+}
+
+// NewMarkdownHTMLValue creates a Value which describes JSON string of HTML rendered from md by renderer.
+// The rendered HTML is escaped and streamed as it is rendered.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewMarkdownHTMLValue(key string, md []byte, renderer MarkdownRenderer) (*Value, error) {
+	return w.newValue(key, w.markdownHTMLValueFunc(md, renderer))
+}
+
+// MustNewMarkdownHTMLValue creates a Value which describes JSON string of HTML rendered from md by renderer.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewMarkdownHTMLValue(key string, md []byte, renderer MarkdownRenderer) *Value {
+	return w.mustNewValue(key, w.markdownHTMLValueFunc(md, renderer))
+}
+
+func (w *Writer) markdownHTMLValueFunc(md []byte, renderer MarkdownRenderer) ValueFunc {
+	return func(out io.Writer) error {
+		return w.writeString(out, func(w io.Writer) error {
+			return renderer.Render(w, md)
+		})
+	}
+}
+
+// writeString writes the output of f to out as JSON string, escaping it on the fly.
+func (w *Writer) writeString(out io.Writer, f func(w io.Writer) error) error {
+	if _, err := out.Write([]byte(`"`)); err != nil {
+		return err
+	}
+
+	se := &stringEscaper{w: out, escapeHTML: w.escapeHTML}
+	if err := f(se); err != nil {
+		return err
+	}
+	if err := se.close(); err != nil {
+		return err
+	}
+
+	if _, err := out.Write([]byte(`"`)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// stringEscaper escapes bytes written to it as the content of JSON string in the same way as json.Marshal,
+// e.g. invalid UTF-8 is replaced with U+FFFD and U+2028 and U+2029 are escaped.
+// A multi-byte character split among writes is held until its last byte is written.
+type stringEscaper struct {
+	w          io.Writer
+	escapeHTML bool   // <, > and & are escaped as WithEscapeHTML configures
+	pending    []byte // the leading bytes of an incomplete character
+	in         []byte
+	buf        []byte
+}
+
+const hexDigits = "0123456789abcdef"
+
+func (se *stringEscaper) Write(p []byte) (int, error) {
+	in := p
+	if len(se.pending) > 0 {
+		se.in = append(append(se.in[:0], se.pending...), p...)
+		in = se.in
+		se.pending = se.pending[:0]
+	}
+
+	se.buf = se.buf[:0]
+	for i := 0; i < len(in); {
+		b := in[i]
+		if b < utf8.RuneSelf {
+			se.escapeByte(b)
+			i++
+			continue
+		}
+
+		if !utf8.FullRune(in[i:]) {
+			// the rest comes in the next write.
+			se.pending = append(se.pending, in[i:]...)
+			break
+		}
+		r, size := utf8.DecodeRune(in[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			se.buf = append(se.buf, `\ufffd`...)
+		case r == '\u2028' || r == '\u2029':
+			se.buf = append(se.buf, '\\', 'u', '2', '0', '2', hexDigits[r&0xf])
+		default:
+			se.buf = append(se.buf, in[i:i+size]...)
+		}
+		i += size
+	}
+
+	if _, err := se.w.Write(se.buf); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// escapeByte appends the escaped ASCII character b.
+func (se *stringEscaper) escapeByte(b byte) {
+	switch {
+	case b == '"' || b == '\\':
+		se.buf = append(se.buf, '\\', b)
+	case b == '\n':
+		se.buf = append(se.buf, '\\', 'n')
+	case b == '\r':
+		se.buf = append(se.buf, '\\', 'r')
+	case b == '\t':
+		se.buf = append(se.buf, '\\', 't')
+	case b == '\b':
+		se.buf = append(se.buf, '\\', 'b')
+	case b == '\f':
+		se.buf = append(se.buf, '\\', 'f')
+	case b < 0x20 || se.escapeHTML && (b == '<' || b == '>' || b == '&'):
+		se.buf = append(se.buf, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xf])
+	default:
+		se.buf = append(se.buf, b)
+	}
+}
+
+// close writes each byte of the incomplete character left at the end as U+FFFD.
+func (se *stringEscaper) close() error {
+	if len(se.pending) == 0 {
+		return nil
+	}
+
+	se.buf = se.buf[:0]
+	for range se.pending {
+		se.buf = append(se.buf, `\ufffd`...)
+	}
+	se.pending = se.pending[:0]
+
+	_, err := se.w.Write(se.buf)
+	return err
+}
@@ -0,0 +1,225 @@
+package writer_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+func TestMultiReaderBase64StringValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	// lengths are not multiple of 3, so base64 groups span the readers.
+	root := struct {
+		Data *writer.Value
+	}{
+		Data: w.MustNewMultiReaderBase64StringValue("data",
+			bytes.NewReader([]byte("ab")),
+			bytes.NewReader([]byte("cdefg")),
+			bytes.NewReader([]byte{0, 1, 0xff, 0xfe}),
+		),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	var result struct {
+		Data []byte
+	}
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected := []byte("abcdefg\x00\x01\xff\xfe"); !bytes.Equal(result.Data, expected) {
+		t.Fatalf("result expected:%v, but was %v", expected, result.Data)
+	}
+}
+
+func TestCompressedValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	text := strings.Repeat("large text blob ", 1000)
+
+	root := struct {
+		Name string
+		Blob *writer.Value
+	}{
+		Name: "root",
+		Blob: w.MustNewCompressedValue("blob", func(w io.Writer) error {
+			jsn, err := json.Marshal(map[string]string{"text": text})
+			if err != nil {
+				return err
+			}
+			_, err = w.Write(jsn)
+			return err
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if buf.Len() > len(text)/10 {
+		t.Errorf("output must be compressed, but was %d bytes", buf.Len())
+	}
+
+	// reconstruct as the client does.
+	var result struct {
+		Name string
+		Blob struct {
+			Encoding string
+			Data     []byte
+		}
+	}
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "gzip", result.Blob.Encoding; actual != expected {
+		t.Fatalf("encoding expected:%s, but was %s", expected, actual)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(result.Blob.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var blob map[string]string
+	if err := json.Unmarshal(decompressed, &blob); err != nil {
+		t.Fatal(err)
+	}
+	if blob["text"] != text {
+		t.Errorf("decompressed text mismatch: %s", decompressed)
+	}
+}
+
+// stubRenderer renders only headings and paragraphs.
+type stubRenderer struct{}
+
+func (stubRenderer) Render(w io.Writer, source []byte) error {
+	for _, line := range strings.Split(string(source), "\n") {
+		var err error
+		switch {
+		case line == "":
+			continue
+		case strings.HasPrefix(line, "# "):
+			_, err = io.WriteString(w, "<h1>"+line[2:]+"</h1>\n")
+		default:
+			_, err = io.WriteString(w, "<p>"+line+"</p>\n")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestMarkdownHTMLValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	md := "# Title \"quoted\"\n\nback\\slash & tab\t日本語\x01"
+
+	root := struct {
+		HTML *writer.Value
+	}{
+		HTML: w.MustNewMarkdownHTMLValue("html", []byte(md), stubRenderer{}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	var result struct {
+		HTML string
+	}
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "<h1>Title \"quoted\"</h1>\n<p>back\\slash & tab\t日本語\x01</p>\n"
+	if result.HTML != expected {
+		t.Fatalf("result expected:%q, but was %q", expected, result.HTML)
+	}
+
+	// escaped in the same way as json.Marshal.
+	jsn, err := json.Marshal(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := string(jsn)+"\n", buf.String(); actual != expected {
+		t.Errorf("output expected:%s, but was %s", expected, actual)
+	}
+}
+
+// byteRenderer writes the source byte by byte, splitting multi-byte characters among writes.
+type byteRenderer struct{}
+
+func (byteRenderer) Render(w io.Writer, source []byte) error {
+	for _, b := range source {
+		if _, err := w.Write([]byte{b}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestMarkdownHTMLValueUTF8(t *testing.T) {
+	for _, test := range []struct {
+		src      string
+		expected string
+	}{
+		{src: "日本語 \u2028 \u2029 <&>", expected: `"日本語 \u2028 \u2029 \u003c\u0026\u003e"`},
+		{src: "invalid \xff\xfe bytes", expected: `"invalid \ufffd\ufffd bytes"`},
+		{src: "truncated \xe6\x97 in the middle", expected: `"truncated \ufffd\ufffd in the middle"`},
+		{src: "truncated at the end \xe6\x97", expected: `"truncated at the end \ufffd\ufffd"`},
+	} {
+		buf := new(bytes.Buffer)
+		w := writer.New(buf)
+
+		v := w.MustNewMarkdownHTMLValue("md", []byte(test.src), byteRenderer{})
+		if err := w.Encode(v); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := test.expected+"\n", buf.String(); actual != expected {
+			t.Errorf("output expected:%s, but was %s", expected, actual)
+		}
+		if !json.Valid(buf.Bytes()) {
+			t.Errorf("output must be valid: %s", buf)
+		}
+	}
+}
+
+func TestHashStringValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	root := struct {
+		Digest *writer.Value
+	}{
+		Digest: w.MustNewHashStringValue("digest", strings.NewReader("hello world"), sha256.New),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Digest":"b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9"}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
@@ -0,0 +1,117 @@
+package writer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Sub creates a child Writer which has the same options and output as w, but its own registry of values,
+// so that a callback of w can write a JSON document containing further streamed values.
+// The placeholders of the child are expanded wherever they flow into w: in the document written to w,
+// in the values of w including the output of ValueFunc, ValueFuncCtx and ElementWriter.WriteElementFunc,
+// which is otherwise written verbatim,
+// and in the document written to the child itself.
+// Keys are scoped to each Writer, so the child may register the same key as w or its other children.
+// The placeholders of a child are expanded only by the child and its ancestors.
+// A callback writing the placeholders of a child must create the child before it starts writing.
+// The options applying to the whole document, i.e. WithSchema, WithHash and WithRateLimit, are left to w,
+// through which the output of the child passes, so Close and Sum of the child do nothing.
+func (w *Writer) Sub() *Writer {
+	w.lock()
+	defer w.unlock()
+
+	sub := newWriter(w.opts)
+	// the document-level options are done by the output chain of w.
+	// minify is kept to reject NDJSON values, whose lines would be joined by w.
+	sub.schema = nil
+	sub.hash = nil
+	sub.bytesPerSec = 0
+	sub.now = w.now
+	sub.nonce = w.nonce + newNonce()
+
+	// the output is shared with w.
+	sub.w = w.w
+	sub.exp = sub.newExpander(sub.ctx, sub.w)
+
+	w.subs = append(w.subs, sub)
+
+	return sub
+}
+
+// subFor returns the child which key belongs to, and the key within it.
+// key is the one within w, i.e. the nonce of w is trimmed. It returns nil if no child has key.
+func (w *Writer) subFor(key string) (*Writer, string) {
+	w.lock()
+	defer w.unlock()
+
+	for _, sub := range w.subs {
+		scope := sub.nonce[len(w.nonce):]
+		if strings.HasPrefix(key, scope) {
+			return sub, key[len(scope):]
+		}
+	}
+
+	return nil, ""
+}
+
+// keyOf returns the key of v within w, which is put after the nonce of w in the placeholder of v.
+// It returns false if v can't belong to w or its children.
+func (w *Writer) keyOf(v *Value) (string, bool) {
+	if v.w.marker != w.marker || !strings.HasPrefix(v.w.nonce, w.nonce) {
+		return "", false
+	}
+	return v.w.nonce[len(w.nonce):] + v.ref(), true
+}
+
+// subsWriter writes the output of callbacks to w expanding the placeholders of the children of parent.
+// The expansion starts when the first child is created, so that the output is written through without children.
+type subsWriter struct {
+	parent *Writer
+	ctx    context.Context
+	w      io.Writer
+	x      *expander
+
+	written bool // anything has been written
+}
+
+func (w *Writer) newSubsWriter(ctx context.Context, out io.Writer) *subsWriter {
+	return &subsWriter{parent: w, ctx: ctx, w: out}
+}
+
+func (sw *subsWriter) Write(p []byte) (n int, err error) {
+	if len(p) > 0 {
+		sw.written = true
+	}
+
+	if sw.x == nil {
+		sw.parent.lock()
+		hasSubs := len(sw.parent.subs) > 0
+		sw.parent.unlock()
+
+		if !hasSubs {
+			return sw.w.Write(p)
+		}
+		sw.x = sw.parent.newExpander(sw.ctx, sw.w)
+		sw.x.scoped = true
+	}
+
+	return sw.x.Write(p)
+}
+
+// Flush flushes the underlying writer.
+func (sw *subsWriter) Flush() error {
+	return flush(sw.w)
+}
+
+// omit writes null for ErrOmitValue returned by a callback, unless anything has been written.
+// Other errors are returned as they are.
+func (sw *subsWriter) omit(err error) error {
+	if !errors.Is(err, ErrOmitValue) || sw.written {
+		return err
+	}
+
+	_, err = sw.w.Write([]byte("null"))
+	return err
+}
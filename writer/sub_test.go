@@ -0,0 +1,143 @@
+package writer_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+func TestSub(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	v := w.MustNewValue("page", func(out io.Writer) error {
+		sub := w.Sub()
+
+		// the same key as the parent's.
+		items := sub.MustNewArrayValue("page", func(w writer.ElementWriter) error {
+			for i := 0; i < 3; i++ {
+				if err := w.WriteElement(i); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		return json.NewEncoder(out).Encode(map[string]interface{}{
+			"items":   items,
+			"genuine": writer.Sentinel() + "page",
+		})
+	})
+
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"page": v}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"page":{"genuine":"\\🎏page","items":[0,1,2]}` + "\n}\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestSubDocumentOptions(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithSchema(&requiredValidator{array: "Items", required: []string{"id"}}), writer.WithHash(sha256.New()))
+
+	var sub *writer.Writer
+	v := w.MustNewValue("items", func(out io.Writer) error {
+		sub = w.Sub()
+		item := sub.MustNewValue("item", func(w io.Writer) error {
+			_, err := w.Write([]byte(`{"id":1}`))
+			return err
+		})
+		return json.NewEncoder(out).Encode([]interface{}{item})
+	})
+
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"Items": v}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the child leaves the whole document to the parent.
+	if err := sub.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if sum := sub.Sum(); sum != nil {
+		t.Fatalf("sum of the child expected nil, but was %x", sum)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("nothing expected before Close of the parent, but was %s", buf.String())
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"Items":[{"id":1}]` + "\n}\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+	if actual, expected := w.Sum(), sha256.Sum256([]byte(expected)); !bytes.Equal(actual, expected[:]) {
+		t.Fatalf("sum expected:%x, but was %x", expected, actual)
+	}
+}
+
+func TestSubNested(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithNonce())
+
+	sub := w.Sub()
+	subsub := sub.Sub()
+
+	leaf := subsub.MustNewValue("v", func(w io.Writer) error {
+		_, err := w.Write([]byte(`"leaf"`))
+		return err
+	})
+	inner := sub.MustNewObjectValue("v", func(w writer.ObjectWriter) error {
+		return w.WriteMember("leaf", leaf)
+	})
+	outer := w.MustNewValue("v", func(w io.Writer) error {
+		_, err := w.Write([]byte(`"outer"`))
+		return err
+	})
+
+	// the placeholders of the children can be written to the parent directly.
+	if err := json.NewEncoder(w).Encode([]interface{}{outer, inner, leaf}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `["outer",{"leaf":"leaf"},"leaf"]` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+
+	if keys := w.UnusedKeys(); len(keys) != 0 {
+		t.Fatalf("unused keys expected none, but was %v", keys)
+	}
+	if keys := subsub.UnusedKeys(); len(keys) != 0 {
+		t.Fatalf("unused keys expected none, but was %v", keys)
+	}
+}
+
+func TestSubScope(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+	sub := w.Sub()
+
+	v := w.MustNewValue("v", func(w io.Writer) error {
+		_, err := w.Write([]byte(`1`))
+		return err
+	})
+
+	// the placeholders of the parent are written verbatim by the child.
+	if err := json.NewEncoder(sub).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `"\\🎏v"` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
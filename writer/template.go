@@ -0,0 +1,185 @@
+package writer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// NewBoundTemplateValue creates a Value which describes template bound to data.
+// template is a JSON document, in which every string value of the form "{{<JSONPath>}}" is replaced
+// with the JSON of the value in data resolved by the JSONPath, e.g. "{{$.items[0].name}}".
+// Supported JSONPath syntax is the root $, child .name or ['name'], and index [n], where negative n counts from the end.
+// data is resolved as it is encoded by json.Marshal.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewBoundTemplateValue(key string, template []byte, data interface{}) (*Value, error) {
+	return w.newValue(key, w.boundTemplateValueFunc(template, data))
+}
+
+// MustNewBoundTemplateValue creates a Value which describes template bound to data.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewBoundTemplateValue(key string, template []byte, data interface{}) *Value {
+	return w.mustNewValue(key, w.boundTemplateValueFunc(template, data))
+}
+
+func (w *Writer) boundTemplateValueFunc(template []byte, data interface{}) ValueFunc {
+	return func(out io.Writer) error {
+		// normalize data into generic JSON values.
+		jsn, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		var root interface{}
+		dec := json.NewDecoder(bytes.NewReader(jsn))
+		dec.UseNumber()
+		if err := dec.Decode(&root); err != nil {
+			return err
+		}
+
+		var s scanner
+		var bound bytes.Buffer
+		start := -1 // the start of the current string value
+		for i, b := range template {
+			onString := s.onString
+			_ = s.step(b)
+
+			if !onString && s.onString && !s.onKey {
+				start = i
+				continue
+			}
+			if start >= 0 {
+				if onString && !s.onString {
+					if err := w.bindString(&bound, template[start:i+1], root); err != nil {
+						return err
+					}
+					start = -1
+				}
+				continue
+			}
+
+			_ = bound.WriteByte(b)
+		}
+		if start >= 0 {
+			return fmt.Errorf("template has unterminated string")
+		}
+
+		if _, err := out.Write(bound.Bytes()); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
+
+// bindString writes the value resolved by the placeholder in quoted, or quoted as it is if it's not a placeholder.
+func (w *Writer) bindString(out *bytes.Buffer, quoted []byte, root interface{}) error {
+	var str string
+	if err := json.Unmarshal(quoted, &str); err != nil {
+		return err
+	}
+
+	if !strings.HasPrefix(str, "{{") || !strings.HasSuffix(str, "}}") {
+		_, _ = out.Write(quoted)
+		return nil
+	}
+
+	path := strings.TrimSpace(str[2 : len(str)-2])
+	v, err := evalJSONPath(path, root)
+	if err != nil {
+		return fmt.Errorf("template placeholder %s: %w", str, err)
+	}
+
+	jsn, err := w.marshal(v)
+	if err != nil {
+		return err
+	}
+	_, _ = out.Write(jsn)
+
+	return nil
+}
+
+// evalJSONPath resolves path against root, which consists of generic JSON values.
+func evalJSONPath(path string, root interface{}) (interface{}, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("JSONPath must start with $")
+	}
+
+	cur := root
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			name := rest[1 : end+1]
+			if name == "" {
+				return nil, fmt.Errorf("empty name in %s", path)
+			}
+			v, err := child(cur, name)
+			if err != nil {
+				return nil, err
+			}
+			cur = v
+			rest = rest[end+1:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed bracket in %s", path)
+			}
+			sel := rest[1:end]
+			var v interface{}
+			var err error
+			if len(sel) >= 2 && (sel[0] == '\'' || sel[0] == '"') && sel[len(sel)-1] == sel[0] {
+				v, err = child(cur, sel[1:len(sel)-1])
+			} else {
+				v, err = index(cur, sel)
+			}
+			if err != nil {
+				return nil, err
+			}
+			cur = v
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("unexpected %q in %s", rest[0], path)
+		}
+	}
+
+	return cur, nil
+}
+
+func child(v interface{}, name string) (interface{}, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot get %s of non-object", name)
+	}
+	c, ok := m[name]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", name)
+	}
+	return c, nil
+}
+
+func index(v interface{}, sel string) (interface{}, error) {
+	a, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot index non-array with %s", sel)
+	}
+	i, err := strconv.Atoi(sel)
+	if err != nil {
+		return nil, fmt.Errorf("invalid index %s", sel)
+	}
+	if i < 0 {
+		i += len(a)
+	}
+	if i < 0 || i >= len(a) {
+		return nil, fmt.Errorf("index %s out of range", sel)
+	}
+	return a[i], nil
+}
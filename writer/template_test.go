@@ -0,0 +1,81 @@
+package writer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+func TestBoundTemplateValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	type Item struct {
+		Name  string `json:"name"`
+		Price int    `json:"price"`
+	}
+	data := map[string]interface{}{
+		"title": "Monthly Report",
+		"owner": map[string]interface{}{"name": "knightso", "tags": []string{"a", "b"}},
+		"items": []*Item{{Name: "apple", Price: 100}, {Name: "banana", Price: 200}},
+	}
+
+	template := []byte(`{
+  "report": "{{$.title}}",
+  "{{$.title}}": "keys are not bound",
+  "owner": "{{ $['owner'].name }}",
+  "tags": "{{$.owner.tags}}",
+  "first": "{{$.items[0]}}",
+  "last": {"price": "{{$.items[-1].price}}"},
+  "literal": "not {{$.title}}"
+}`)
+
+	root := struct {
+		Report *writer.Value
+	}{
+		Report: w.MustNewBoundTemplateValue("report", template, data),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Report":{
+  "report": "Monthly Report",
+  "{{$.title}}": "keys are not bound",
+  "owner": "knightso",
+  "tags": ["a","b"],
+  "first": {"name":"apple","price":100},
+  "last": {"price": 200},
+  "literal": "not {{$.title}}"
+}}
+`
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestBoundTemplateValueNotFound(t *testing.T) {
+	for _, template := range []string{
+		`{"a":"{{$.missing}}"}`,
+		`{"a":"{{$.items[2]}}"}`,
+		`{"a":"{{$.items.name}}"}`,
+		`{"a":"{{items}}"}`,
+	} {
+		w := writer.New(new(bytes.Buffer))
+
+		root := struct {
+			Report *writer.Value
+		}{
+			Report: w.MustNewBoundTemplateValue("report", []byte(template), map[string]interface{}{
+				"items": []int{1, 2},
+			}),
+		}
+
+		if err := json.NewEncoder(w).Encode(&root); err == nil {
+			t.Errorf("%s: error expected", template)
+		}
+	}
+}
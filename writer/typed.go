@@ -0,0 +1,43 @@
+package writer
+
+// TypedElementWriter encodes and writes array elements of type T.
+type TypedElementWriter[T any] interface {
+	// WriteElement encodes and writes an array element.
+	WriteElement(e T) error
+
+	// Count returns the number of the elements written so far.
+	Count() int
+}
+
+// NewTypedArrayValue creates a Value which describes JSON array of elements of type T.
+// It is a function rather than a method of Writer, since methods can't have type parameters.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func NewTypedArrayValue[T any](w *Writer, key string, f func(w TypedElementWriter[T]) error, opts ...ArrayOption) (*Value, error) {
+	return w.NewArrayValue(key, typedArrayValueFunc(f), opts...)
+}
+
+// MustNewTypedArrayValue creates a Value which describes JSON array of elements of type T.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func MustNewTypedArrayValue[T any](w *Writer, key string, f func(w TypedElementWriter[T]) error, opts ...ArrayOption) *Value {
+	return w.MustNewArrayValue(key, typedArrayValueFunc(f), opts...)
+}
+
+func typedArrayValueFunc[T any](f func(w TypedElementWriter[T]) error) ArrayValueFunc {
+	return func(w ElementWriter) error {
+		return f(&typedElementWriter[T]{w: w})
+	}
+}
+
+type typedElementWriter[T any] struct {
+	w ElementWriter
+}
+
+func (tw *typedElementWriter[T]) WriteElement(e T) error {
+	return tw.w.WriteElement(e)
+}
+
+func (tw *typedElementWriter[T]) Count() int {
+	return tw.w.Count()
+}
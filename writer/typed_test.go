@@ -0,0 +1,61 @@
+package writer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+func TestTypedArrayValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	type Item struct {
+		ID   int
+		Name string
+	}
+
+	root := struct {
+		Ints    *writer.Value
+		Strings *writer.Value
+		Items   *writer.Value
+	}{
+		Ints: writer.MustNewTypedArrayValue(w, "ints", func(w writer.TypedElementWriter[int]) error {
+			for i := 0; i < 3; i++ {
+				if err := w.WriteElement(i); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+		Strings: writer.MustNewTypedArrayValue(w, "strings", func(w writer.TypedElementWriter[string]) error {
+			for i := 0; i < 2; i++ {
+				if err := w.WriteElement(fmt.Sprintf("s%d", i)); err != nil {
+					return err
+				}
+			}
+			return nil
+		}),
+		Items: writer.MustNewTypedArrayValue(w, "items", func(w writer.TypedElementWriter[*Item]) error {
+			return w.WriteElement(&Item{ID: 1, Name: "a"})
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Ints":[0,1,2],"Strings":["s0","s1"],"Items":[{"ID":1,"Name":"a"}]}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+
+	if _, err := writer.NewTypedArrayValue(w, "ints", func(w writer.TypedElementWriter[int]) error {
+		return nil
+	}); err != writer.ErrDuplicateKey {
+		t.Fatalf("ErrDuplicateKey expected, but was %v", err)
+	}
+}
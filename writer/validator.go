@@ -0,0 +1,291 @@
+package writer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+type validState int
+
+const (
+	vsValue      validState = iota // a value is expected
+	vsValueOrEnd                   // a value or ']' is expected, just after '['
+	vsKeyOrEnd                     // a key or '}' is expected, just after '{'
+	vsKey                          // a key is expected, just after ','
+	vsColon                        // ':' is expected after a key
+	vsAfter                        // ',' or the end of the container is expected after a value
+	vsString
+	vsNumber
+	vsLiteral // true, false or null
+	vsDone    // the value has been completed
+)
+
+// validator checks JSON passed through byte by byte is a well-formed single value,
+// or newline-delimited values if lines is set.
+type validator struct {
+	lines    bool
+	stack    []byte // '{' or '['
+	state    validState
+	key      bool   // the current string is an object key
+	escaping bool   // just after '\' in a string
+	hex      int    // the number of hex digits remaining in \u escape
+	literal  string // the rest of the current literal
+	num      []byte // the current number
+}
+
+// step validates b.
+func (v *validator) step(b byte) error {
+	switch v.state {
+	case vsString:
+		switch {
+		case v.hex > 0:
+			if !isHex(b) {
+				return fmt.Errorf("invalid character %q in \\u escape", b)
+			}
+			v.hex--
+		case v.escaping:
+			switch b {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+			case 'u':
+				v.hex = 4
+			default:
+				return fmt.Errorf("invalid escape \\%c", b)
+			}
+			v.escaping = false
+		case b == '\\':
+			v.escaping = true
+		case b == '"':
+			if v.key {
+				v.state = vsColon
+			} else {
+				v.endValue()
+			}
+		case b < 0x20:
+			return fmt.Errorf("invalid control character %q in string", b)
+		}
+		return nil
+	case vsNumber:
+		if b >= '0' && b <= '9' || b == '-' || b == '+' || b == '.' || b == 'e' || b == 'E' {
+			v.num = append(v.num, b)
+			return nil
+		}
+		if err := v.endNumber(); err != nil {
+			return err
+		}
+		// b is processed in the next state.
+	case vsLiteral:
+		if b != v.literal[0] {
+			return fmt.Errorf("invalid character %q in literal", b)
+		}
+		v.literal = v.literal[1:]
+		if v.literal == "" {
+			v.endValue()
+		}
+		return nil
+	}
+
+	if b == '\n' && v.lines && v.state == vsDone {
+		// the next line starts.
+		v.state = vsValue
+		return nil
+	}
+
+	if b == ' ' || b == '\t' || b == '\n' || b == '\r' {
+		return nil
+	}
+
+	switch v.state {
+	case vsValue, vsValueOrEnd:
+		if b == ']' && v.state == vsValueOrEnd {
+			v.endContainer()
+			return nil
+		}
+		return v.beginValue(b)
+	case vsKeyOrEnd, vsKey:
+		if b == '"' {
+			v.state = vsString
+			v.key = true
+			return nil
+		}
+		if b == '}' && v.state == vsKeyOrEnd {
+			v.endContainer()
+			return nil
+		}
+		return fmt.Errorf("invalid character %q looking for object key", b)
+	case vsColon:
+		if b != ':' {
+			return fmt.Errorf("invalid character %q after object key", b)
+		}
+		v.state = vsValue
+		return nil
+	case vsAfter:
+		top := v.stack[len(v.stack)-1]
+		switch {
+		case b == ',' && top == '{':
+			v.state = vsKey
+		case b == ',':
+			v.state = vsValue
+		case b == '}' && top == '{', b == ']' && top == '[':
+			v.endContainer()
+		default:
+			return fmt.Errorf("invalid character %q after value", b)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("invalid character %q after top-level value", b)
+}
+
+func (v *validator) beginValue(b byte) error {
+	switch {
+	case b == '{':
+		v.stack = append(v.stack, b)
+		v.state = vsKeyOrEnd
+	case b == '[':
+		v.stack = append(v.stack, b)
+		v.state = vsValueOrEnd
+	case b == '"':
+		v.state = vsString
+		v.key = false
+	case b == '-' || b >= '0' && b <= '9':
+		v.state = vsNumber
+		v.num = append(v.num[:0], b)
+	case b == 't':
+		v.state, v.literal = vsLiteral, "rue"
+	case b == 'f':
+		v.state, v.literal = vsLiteral, "alse"
+	case b == 'n':
+		v.state, v.literal = vsLiteral, "ull"
+	default:
+		return fmt.Errorf("invalid character %q looking for value", b)
+	}
+	return nil
+}
+
+func (v *validator) endContainer() {
+	v.stack = v.stack[:len(v.stack)-1]
+	v.endValue()
+}
+
+func (v *validator) endValue() {
+	if len(v.stack) == 0 {
+		v.state = vsDone
+	} else {
+		v.state = vsAfter
+	}
+}
+
+func (v *validator) endNumber() error {
+	if !isNumber(v.num) {
+		return fmt.Errorf("invalid number %s", v.num)
+	}
+	v.endValue()
+	return nil
+}
+
+// end reports whether the value has been completed.
+func (v *validator) end() error {
+	if v.state == vsNumber {
+		if err := v.endNumber(); err != nil {
+			return err
+		}
+	}
+	if v.lines && v.state == vsValue && len(v.stack) == 0 {
+		// no element, or a trailing newline.
+		return nil
+	}
+	if v.state != vsDone {
+		return errors.New("unexpected end of JSON")
+	}
+	return nil
+}
+
+func isHex(b byte) bool {
+	return b >= '0' && b <= '9' || b >= 'a' && b <= 'f' || b >= 'A' && b <= 'F'
+}
+
+// isNumber reports whether s is a JSON number.
+func isNumber(s []byte) bool {
+	digits := func() int {
+		n := 0
+		for len(s) > 0 && s[0] >= '0' && s[0] <= '9' {
+			s = s[1:]
+			n++
+		}
+		return n
+	}
+
+	if len(s) > 0 && s[0] == '-' {
+		s = s[1:]
+	}
+	if len(s) > 0 && s[0] == '0' {
+		s = s[1:]
+	} else if digits() == 0 {
+		return false
+	}
+	if len(s) > 0 && s[0] == '.' {
+		s = s[1:]
+		if digits() == 0 {
+			return false
+		}
+	}
+	if len(s) > 0 && (s[0] == 'e' || s[0] == 'E') {
+		s = s[1:]
+		if len(s) > 0 && (s[0] == '+' || s[0] == '-') {
+			s = s[1:]
+		}
+		if digits() == 0 {
+			return false
+		}
+	}
+	return len(s) == 0
+}
+
+// ErrEmptyValue is returned with WithValidation when a callback writes nothing,
+// which would leave the place of the value empty, e.g. {"key":}.
+var ErrEmptyValue = errors.New("empty value")
+
+// validatingWriter validates the value written to w, and fails before writing malformed bytes.
+type validatingWriter struct {
+	w       io.Writer
+	v       validator
+	err     error
+	written bool // any byte has been written
+}
+
+func (vw *validatingWriter) Write(p []byte) (int, error) {
+	if vw.err != nil {
+		return 0, vw.err
+	}
+
+	for _, b := range p {
+		if err := vw.v.step(b); err != nil {
+			vw.err = fmt.Errorf("invalid JSON: %w", err)
+			return 0, vw.err
+		}
+	}
+
+	if len(p) > 0 {
+		vw.written = true
+	}
+	return vw.w.Write(p)
+}
+
+func (vw *validatingWriter) Flush() error {
+	return flush(vw.w)
+}
+
+// close reports an error if the value is malformed or incomplete.
+func (vw *validatingWriter) close() error {
+	if vw.err != nil {
+		return vw.err
+	}
+	if !vw.written && !vw.v.lines {
+		return ErrEmptyValue
+	}
+	if err := vw.v.end(); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	return nil
+}
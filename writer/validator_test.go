@@ -0,0 +1,121 @@
+package writer_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+func TestWithValidation(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		valid bool
+	}{
+		{value: `1`, valid: true},
+		{value: `-0.5e+10`, valid: true},
+		{value: ` "a\"\\é" `, valid: true},
+		{value: `{"a":[true,false,null,{}],"b":[]}`, valid: true},
+		{value: "[ 1 ,\n 2 ]", valid: true},
+		{value: `{"a":1,}`},
+		{value: `[1 2]`},
+		{value: `{"a" 1}`},
+		{value: `01`},
+		{value: `1.`},
+		{value: `-`},
+		{value: `tru`},
+		{value: `nul1`},
+		{value: `"\x"`},
+		{value: `"\u12g4"`},
+		{value: "\"\n\""},
+		{value: `[1`},
+		{value: `1 2`},
+		{value: `{1:2}`},
+		{value: `]`},
+		{value: ``},
+	} {
+		buf := new(bytes.Buffer)
+		w := writer.New(buf, writer.WithValidation())
+
+		root := struct {
+			Value *writer.Value
+		}{
+			Value: w.MustNewValue("myKey", func(w io.Writer) error {
+				// written byte by byte, so that a malformed byte is detected in the middle.
+				for i := 0; i < len(test.value); i++ {
+					if _, err := w.Write([]byte{test.value[i]}); err != nil {
+						return err
+					}
+				}
+				return nil
+			}),
+		}
+
+		err := json.NewEncoder(w).Encode(&root)
+		if test.valid {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.value, err)
+			} else if expected, actual := `{"Value":`+test.value+"}\n", buf.String(); actual != expected {
+				t.Errorf("result expected:%s, but was %s", expected, actual)
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Errorf("%s: error expected", test.value)
+			continue
+		}
+		if !strings.Contains(err.Error(), "myKey") {
+			t.Errorf("%s: error must name the key, but was %v", test.value, err)
+		}
+	}
+}
+
+func TestWithValidationFailFast(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithValidation())
+
+	root := struct {
+		Value *writer.Value
+	}{
+		Value: w.MustNewValue("value", func(w io.Writer) error {
+			// the error of the first Write is ignored.
+			_, _ = w.Write([]byte(`[1 2`))
+			_, err := w.Write([]byte(`]`))
+			return err
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err == nil {
+		t.Fatal("error expected")
+	}
+
+	if expected, actual := `{"Value":`, buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWithValidationEmpty(t *testing.T) {
+	w := writer.New(new(bytes.Buffer), writer.WithValidation())
+
+	empty := w.MustNewValue("empty", func(w io.Writer) error { return nil })
+	if err := json.NewEncoder(w).Encode(empty); !errors.Is(err, writer.ErrEmptyValue) || !strings.Contains(err.Error(), `"empty"`) {
+		t.Fatalf("ErrEmptyValue with the key expected, but was %v", err)
+	}
+
+	// an array with no elements is not empty.
+	buf := new(bytes.Buffer)
+	w = writer.New(buf, writer.WithValidation())
+
+	array := w.MustNewArrayValue("array", func(w writer.ElementWriter) error { return nil })
+	if err := json.NewEncoder(w).Encode(array); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "[]\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
@@ -0,0 +1,368 @@
+package writer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// NewLazyStructValue creates a Value whose content is built by build and marshalled when the value is streamed.
+// Both the construction and the marshalling are deferred until the placeholder is reached.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewLazyStructValue(key string, build func() (interface{}, error)) (*Value, error) {
+	return w.newValue(key, w.lazyStructValueFunc(build))
+}
+
+// MustNewLazyStructValue creates a Value whose content is built by build and marshalled when the value is streamed.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewLazyStructValue(key string, build func() (interface{}, error)) *Value {
+	return w.mustNewValue(key, w.lazyStructValueFunc(build))
+}
+
+func (w *Writer) lazyStructValueFunc(build func() (interface{}, error)) ValueFunc {
+	return func(out io.Writer) error {
+		s, err := build()
+		if err != nil {
+			return err
+		}
+
+		jsn, err := w.marshal(s)
+		if err != nil {
+			return err
+		}
+
+		if _, err := out.Write(jsn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
+
+// NewSizedValue creates a Value with estimated size of its output in bytes.
+// The estimate is advisory and not enforced. See Writer.EstimatedBytes.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewSizedValue(key string, estimatedBytes int64, f ValueFunc) (*Value, error) {
+	return w.newValue(key, f, withEstimate(estimatedBytes))
+}
+
+// MustNewSizedValue creates a Value with estimated size of its output in bytes.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewSizedValue(key string, estimatedBytes int64, f ValueFunc) *Value {
+	return w.mustNewValue(key, f, withEstimate(estimatedBytes))
+}
+
+func withEstimate(estimatedBytes int64) func(v *Value) {
+	return func(v *Value) {
+		v.estimate = estimatedBytes
+	}
+}
+
+// EstimatedBytes returns the sum of the estimates of registered values created by NewSizedValue.
+// It doesn't include the size of the structure written by json.Encoder.
+func (w *Writer) EstimatedBytes() int64 {
+	w.lock()
+	defer w.unlock()
+
+	var sum int64
+	for _, v := range w.m {
+		sum += v.estimate
+	}
+	return sum
+}
+
+// NewMergedObjectValue creates a Value which describes JSON object deep-merged from sources.
+// Objects are merged recursively and later sources override earlier ones,
+// while other values including arrays are replaced as a whole.
+// Each source must be a single JSON object. Keys of the result are sorted, and strings are escaped as WithEscapeHTML configures.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewMergedObjectValue(key string, sources ...json.RawMessage) (*Value, error) {
+	return w.newValue(key, w.mergedObjectValueFunc(sources))
+}
+
+// MustNewMergedObjectValue creates a Value which describes JSON object deep-merged from sources.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewMergedObjectValue(key string, sources ...json.RawMessage) *Value {
+	return w.mustNewValue(key, w.mergedObjectValueFunc(sources))
+}
+
+func (w *Writer) mergedObjectValueFunc(sources []json.RawMessage) ValueFunc {
+	return func(out io.Writer) error {
+		merged := map[string]interface{}{}
+		for i, src := range sources {
+			var m map[string]interface{}
+			dec := json.NewDecoder(bytes.NewReader(src))
+			dec.UseNumber()
+			if err := dec.Decode(&m); err != nil {
+				return fmt.Errorf("source %d: %w", i, err)
+			}
+			if m == nil {
+				return fmt.Errorf("source %d: not an object", i)
+			}
+			if _, err := dec.Token(); err != io.EOF {
+				return fmt.Errorf("source %d: unexpected data after the object", i)
+			}
+			mergeObjects(merged, m)
+		}
+
+		jsn, err := w.marshal(merged)
+		if err != nil {
+			return err
+		}
+
+		if _, err := out.Write(jsn); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
+
+// mergeObjects merges src into dst recursively.
+func mergeObjects(dst, src map[string]interface{}) {
+	for k, sv := range src {
+		if sm, ok := sv.(map[string]interface{}); ok {
+			if dm, ok := dst[k].(map[string]interface{}); ok {
+				mergeObjects(dm, sm)
+				continue
+			}
+		}
+		dst[k] = sv
+	}
+}
+
+// NewFallibleValue creates a Value which is replaced with an error object when f returns error,
+// so that the stream continues on partial failure.
+// The output of f is buffered and written only when f succeeds.
+// The error object is {"error": "<message>"} by default, and can be configured by WithErrorObject.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewFallibleValue(key string, f ValueFunc) (*Value, error) {
+	return w.newValue(key, w.fallibleValueFunc(key, f))
+}
+
+// MustNewFallibleValue creates a Value which is replaced with an error object when f returns error.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewFallibleValue(key string, f ValueFunc) *Value {
+	return w.mustNewValue(key, w.fallibleValueFunc(key, f))
+}
+
+func (w *Writer) fallibleValueFunc(key string, f ValueFunc) ValueFunc {
+	return func(out io.Writer) error {
+		var buf bytes.Buffer
+		if err := f(&flushWriter{&buf}); err != nil {
+			var errObj interface{}
+			if w.errorObject != nil {
+				errObj = w.errorObject(key, err)
+			} else {
+				errObj = map[string]string{"error": err.Error()}
+			}
+
+			jsn, err := w.marshal(errObj)
+			if err != nil {
+				return err
+			}
+
+			_, err = out.Write(jsn)
+			return err
+		}
+
+		_, err := out.Write(buf.Bytes())
+		return err
+	}
+}
+
+// NewCommandValue creates a Value which is the stdout of the command created by command.
+// command is called each time the value is streamed, with the context the value is streamed with,
+// so that exec.CommandContext kills the command when the context is done.
+// The command is run at that time, and its stdout must be a valid JSON value.
+// Its Stdout is set by the Value, while its Stderr is written to as well if it's set.
+// Errors including non-zero exit are returned at that time, with stderr in the message.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewCommandValue(key string, command func(ctx context.Context) *exec.Cmd) (*Value, error) {
+	return w.newValue(key, commandValueFunc(command))
+}
+
+// MustNewCommandValue creates a Value which is the stdout of the command created by command.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewCommandValue(key string, command func(ctx context.Context) *exec.Cmd) *Value {
+	return w.mustNewValue(key, commandValueFunc(command))
+}
+
+func commandValueFunc(command func(ctx context.Context) *exec.Cmd) ValueFuncCtx {
+	return func(ctx context.Context, w io.Writer) error {
+		cmd := command(ctx)
+
+		var stderr bytes.Buffer
+		cmd.Stdout = w
+		if cmd.Stderr != nil {
+			cmd.Stderr = io.MultiWriter(cmd.Stderr, &stderr)
+		} else {
+			cmd.Stderr = &stderr
+		}
+
+		if err := cmd.Run(); err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				return fmt.Errorf("command %s exited with status %d: %s", cmd.Path, exitErr.ExitCode(), strings.TrimSpace(stderr.String()))
+			}
+			return fmt.Errorf("command %s: %w", cmd.Path, err)
+		}
+
+		return nil
+	}
+}
+
+// NewReaderValue creates a Value whose content is copied from r when the value is streamed.
+// r must yield valid JSON, which is written as it is.
+// r is consumed exactly once, so error is returned when the placeholder is reached again.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewReaderValue(key string, r io.Reader) (*Value, error) {
+	return w.newValue(key, readerValueFunc(key, r))
+}
+
+// MustNewReaderValue creates a Value whose content is copied from r when the value is streamed.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewReaderValue(key string, r io.Reader) *Value {
+	return w.mustNewValue(key, readerValueFunc(key, r))
+}
+
+func readerValueFunc(key string, r io.Reader) ValueFunc {
+	var consumed bool
+	return func(w io.Writer) error {
+		if consumed {
+			return fmt.Errorf("reader of %s has already been consumed", key)
+		}
+		consumed = true
+
+		if _, err := io.Copy(w, r); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
+
+// ReaderValueFunc is a callback function which opens the reader of a JSON value lazily, e.g. a file.
+type ReaderValueFunc func() (io.Reader, error)
+
+// NewReaderValueFunc creates a Value whose content is copied from the reader returned by f.
+// Unlike NewReaderValue, f is called each time the placeholder is reached, so the reader is created only when needed.
+// The reader must yield valid JSON, which is written as it is, and it is closed after copied if it implements io.Closer.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewReaderValueFunc(key string, f ReaderValueFunc) (*Value, error) {
+	return w.newValue(key, lazyReaderValueFunc(f))
+}
+
+// MustNewReaderValueFunc creates a Value whose content is copied from the reader returned by f.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewReaderValueFunc(key string, f ReaderValueFunc) *Value {
+	return w.mustNewValue(key, lazyReaderValueFunc(f))
+}
+
+func lazyReaderValueFunc(f ReaderValueFunc) ValueFunc {
+	return func(w io.Writer) (err error) {
+		r, err := f()
+		if err != nil {
+			return err
+		}
+
+		if c, ok := r.(io.Closer); ok {
+			defer func() {
+				if cerr := c.Close(); err == nil {
+					err = cerr
+				}
+			}()
+		}
+
+		if _, err := io.Copy(w, r); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
+
+// NewBytesValue creates a Value whose content is b, which is already encoded JSON and written verbatim.
+// null is written if b is nil. b must not be modified until the value is streamed.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewBytesValue(key string, b []byte) (*Value, error) {
+	return w.newValue(key, bytesValueFunc(b))
+}
+
+// MustNewBytesValue creates a Value whose content is b, which is already encoded JSON and written verbatim.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewBytesValue(key string, b []byte) *Value {
+	return w.mustNewValue(key, bytesValueFunc(b))
+}
+
+func bytesValueFunc(b []byte) ValueFunc {
+	if b == nil {
+		b = []byte("null")
+	}
+	return func(w io.Writer) error {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
+
+// NewSharedValue creates a Value which can be put in multiple places of the document.
+// f is called only once when the first placeholder is reached, and its output is buffered and replayed for the others.
+// Note that the whole output stays in memory as long as the Value is alive,
+// so a Value put in multiple places by NewValue, which calls f each time, is preferable for a large value cheap to compute.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewSharedValue(key string, f ValueFunc) (*Value, error) {
+	return w.newValue(key, sharedValueFunc(f))
+}
+
+// MustNewSharedValue creates a Value which can be put in multiple places of the document.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewSharedValue(key string, f ValueFunc) *Value {
+	return w.mustNewValue(key, sharedValueFunc(f))
+}
+
+func sharedValueFunc(f ValueFunc) ValueFunc {
+	var once sync.Once
+	var buf bytes.Buffer
+	var ferr error
+	return func(w io.Writer) error {
+		once.Do(func() {
+			ferr = f(&flushWriter{&buf})
+		})
+		if ferr != nil {
+			return ferr
+		}
+
+		if _, err := w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,429 @@
+package writer_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/knightso/json-partial-streaming/writer"
+)
+
+func TestLazyStructValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	type Item struct {
+		Name string
+		Size int
+	}
+
+	var built bool
+	root := struct {
+		Name string
+		Item *writer.Value
+	}{
+		Name: "root",
+		Item: w.MustNewLazyStructValue("item", func() (interface{}, error) {
+			// the structural part must have been written before building.
+			if expected, actual := `{"Name":"root","Item":`, buf.String(); actual != expected {
+				t.Errorf("written before build expected:%s, but was %s", expected, actual)
+			}
+			built = true
+			return &Item{Name: "item", Size: 3}, nil
+		}),
+	}
+
+	if built {
+		t.Fatal("build must not run before streaming")
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if !built {
+		t.Fatal("build must run while streaming")
+	}
+
+	if expected, actual := `{"Name":"root","Item":{"Name":"item","Size":3}}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestMergedObjectValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	root := struct {
+		Config *writer.Value
+	}{
+		Config: w.MustNewMergedObjectValue("config",
+			json.RawMessage(`{"name":"base","db":{"host":"localhost","port":5432},"tags":["a","b"],"debug":false}`),
+			json.RawMessage(`{"db":{"host":"db.example.com","timeout":1.5},"tags":["c"],"debug":true}`),
+		),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Config":{"db":{"host":"db.example.com","port":5432,"timeout":1.5},"debug":true,"name":"base","tags":["c"]}}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestMergedObjectValueNotObject(t *testing.T) {
+	w := writer.New(new(bytes.Buffer))
+
+	root := struct {
+		Config *writer.Value
+	}{
+		Config: w.MustNewMergedObjectValue("config", json.RawMessage(`{"a":1}`), json.RawMessage(`[1]`)),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestMergedObjectValueTrailingData(t *testing.T) {
+	w := writer.New(new(bytes.Buffer))
+
+	v := w.MustNewMergedObjectValue("config", json.RawMessage(`{"a":1} garbage`))
+
+	if err := w.Encode(v); err == nil || !strings.Contains(err.Error(), "source 0") {
+		t.Fatalf("error of source 0 expected, but was %v", err)
+	}
+}
+
+func TestMergedObjectValueEscapeHTML(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithEscapeHTML(false))
+
+	v := w.MustNewMergedObjectValue("config", json.RawMessage(`{"a":"<b>"}`), json.RawMessage(`{"c":"&"}`))
+
+	if err := w.Encode(v); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"a":"<b>","c":"&"}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestEstimatedBytes(t *testing.T) {
+	w := writer.New(new(bytes.Buffer))
+
+	f := func(w io.Writer) error {
+		return nil
+	}
+
+	if expected, actual := int64(0), w.EstimatedBytes(); actual != expected {
+		t.Errorf("EstimatedBytes expected:%d, but was %d", expected, actual)
+	}
+
+	w.MustNewSizedValue("a", 100, f)
+	w.MustNewSizedValue("b", 2000, f)
+	w.MustNewValue("c", f)
+	w.MustNewSizedValue("d", 30000, f)
+
+	if expected, actual := int64(32100), w.EstimatedBytes(); actual != expected {
+		t.Errorf("EstimatedBytes expected:%d, but was %d", expected, actual)
+	}
+}
+
+func TestFallibleValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	root := struct {
+		Failed    *writer.Value
+		Succeeded *writer.Value
+	}{
+		Failed: w.MustNewFallibleValue("failed", func(w io.Writer) error {
+			if _, err := w.Write([]byte(`[1,2`)); err != nil {
+				return err
+			}
+			return errors.New("upstream unavailable")
+		}),
+		Succeeded: w.MustNewFallibleValue("succeeded", func(w io.Writer) error {
+			f, ok := w.(writer.Flusher)
+			if !ok {
+				return fmt.Errorf("%T is not a Flusher", w)
+			}
+			if _, err := w.Write([]byte(`[1,2]`)); err != nil {
+				return err
+			}
+			return f.Flush()
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Failed":{"error":"upstream unavailable"},"Succeeded":[1,2]}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestFallibleValueWithErrorObject(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithErrorObject(func(key string, err error) interface{} {
+		return map[string]interface{}{
+			"key":     key,
+			"message": err.Error(),
+		}
+	}))
+
+	root := struct {
+		Failed *writer.Value
+	}{
+		Failed: w.MustNewFallibleValue("failed", func(w io.Writer) error {
+			return errors.New("oops")
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"Failed":{"key":"failed","message":"oops"}}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestCommandValue(t *testing.T) {
+	if _, err := exec.LookPath("echo"); err != nil {
+		t.Skip("echo is not available")
+	}
+
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	root := struct {
+		Output *writer.Value
+	}{
+		Output: w.MustNewCommandValue("output", func(ctx context.Context) *exec.Cmd {
+			return exec.CommandContext(ctx, "echo", `{"rendered":true}`)
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"Output":{"rendered":true}`+"\n}\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestCommandValueContext(t *testing.T) {
+	if _, err := exec.LookPath("echo"); err != nil {
+		t.Skip("echo is not available")
+	}
+
+	buf := new(bytes.Buffer)
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+	w := writer.New(buf, writer.WithContext(ctx))
+
+	w.MustNewCommandValue("output", func(ctx context.Context) *exec.Cmd {
+		return exec.CommandContext(ctx, "echo", fmt.Sprintf("%q", ctx.Value(ctxKey{})))
+	})
+
+	// the command is created each time, so the value can be streamed again.
+	for i := 0; i < 2; i++ {
+		buf.Reset()
+		if err := w.WriteValue("output", buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if expected, actual := `"request"`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestCommandValueExitError(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	w := writer.New(new(bytes.Buffer))
+
+	root := struct {
+		Output *writer.Value
+	}{
+		Output: w.MustNewCommandValue("output", func(ctx context.Context) *exec.Cmd {
+			return exec.CommandContext(ctx, "sh", "-c", "echo broken >&2; exit 3")
+		}),
+	}
+
+	err := json.NewEncoder(w).Encode(&root)
+	if err == nil {
+		t.Fatal("error expected")
+	}
+	if !strings.Contains(err.Error(), "status 3") || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("error must contain the exit status and stderr, but was %v", err)
+	}
+}
+
+func TestCommandValueNotFound(t *testing.T) {
+	w := writer.New(new(bytes.Buffer))
+
+	root := struct {
+		Output *writer.Value
+	}{
+		Output: w.MustNewCommandValue("output", func(ctx context.Context) *exec.Cmd {
+			return exec.CommandContext(ctx, "json-partial-streaming-no-such-command")
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestReaderValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	root := struct {
+		Body *writer.Value
+	}{
+		Body: w.MustNewReaderValue("body", strings.NewReader(`{"items":[1,2,3]}`)),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"Body":{"items":[1,2,3]}}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+
+	// the reader has been consumed.
+	if err := json.NewEncoder(w).Encode(&root); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+// closeRecorder records whether it is closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (cr *closeRecorder) Close() error {
+	cr.closed = true
+	return nil
+}
+
+func TestReaderValueFunc(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	var readers []*closeRecorder
+	root := struct {
+		Body   *writer.Value
+		Failed *writer.Value
+	}{
+		Body: w.MustNewReaderValueFunc("body", func() (io.Reader, error) {
+			r := &closeRecorder{Reader: strings.NewReader(`{"items":[1,2,3]}`)}
+			readers = append(readers, r)
+			return r, nil
+		}),
+	}
+
+	if len(readers) != 0 {
+		t.Fatal("reader must not be created before the placeholder is reached")
+	}
+
+	// a reader is created for each time.
+	for i := 1; i <= 2; i++ {
+		buf.Reset()
+		if err := json.NewEncoder(w).Encode(&root); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := `{"Body":{"items":[1,2,3]},"Failed":null}`+"\n", buf.String(); actual != expected {
+			t.Fatalf("result expected:%s, but was %s", expected, actual)
+		}
+		if len(readers) != i || !readers[i-1].closed {
+			t.Fatalf("reader expected to be created and closed")
+		}
+	}
+
+	errOpen := errors.New("open failed")
+	root.Failed = w.MustNewReaderValueFunc("failed", func() (io.Reader, error) {
+		return nil, errOpen
+	})
+
+	if err := json.NewEncoder(w).Encode(&root); !errors.Is(err, errOpen) {
+		t.Fatalf("%v expected, but was %v", errOpen, err)
+	}
+}
+
+func TestBytesValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	root := struct {
+		Body *writer.Value
+		Nil  *writer.Value
+	}{
+		Body: w.MustNewBytesValue("body", []byte(`{"items":[1,2,3]}`)),
+		Nil:  w.MustNewBytesValue("nil", nil),
+	}
+
+	// bytes values can be written repeatedly.
+	for i := 0; i < 2; i++ {
+		buf.Reset()
+		if err := json.NewEncoder(w).Encode(&root); err != nil {
+			t.Fatal(err)
+		}
+
+		if expected, actual := `{"Body":{"items":[1,2,3]},"Nil":null}`+"\n", buf.String(); actual != expected {
+			t.Fatalf("result expected:%s, but was %s", expected, actual)
+		}
+	}
+}
+
+func TestSharedValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	var calls int
+	shared := w.MustNewSharedValue("shared", func(w io.Writer) error {
+		calls++
+		_, err := w.Write([]byte(`{"total":100}`))
+		return err
+	})
+
+	root := struct {
+		Summary *writer.Value
+		Details []*writer.Value
+	}{
+		Summary: shared,
+		Details: []*writer.Value{shared, shared},
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"Summary":{"total":100},"Details":[{"total":100},{"total":100}]}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+	if calls != 1 {
+		t.Errorf("calls expected:1, but was %d", calls)
+	}
+}
@@ -2,22 +2,59 @@ package writer
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 // ErrDuplicateKey is returned when registering duplicate key.
 var ErrDuplicateKey = errors.New("duplicate key")
 
+// ErrUnknownKey is returned when a placeholder of unregistered key is reached.
+var ErrUnknownKey = errors.New("unknown key")
+
+// ErrInvalidKey is returned by Writer.Validate for registered keys which are likely to be mistakes.
+var ErrInvalidKey = errors.New("invalid key")
+
+// ErrOmitValue can be returned by ValueFunc, ValueFuncCtx and the callback of ElementWriter.WriteElementFunc
+// to write null in place of the value, if nothing has been written yet. Otherwise it is returned as an error.
+// The value can't be omitted entirely, since its key or the separator in the enclosing structure has already been written.
+// To omit an array element, just don't write it.
+var ErrOmitValue = errors.New("omit value")
+
+// ErrReentrantWrite is returned when Write is called during another Write, e.g. from a callback.
+// It would corrupt the states of the placeholder detection.
+var ErrReentrantWrite = errors.New("reentrant write")
+
 const (
 	streamPrefix     = `\🎏`
 	streamJSONPrefix = `"\\🎏`
+
+	defaultMaxMarkerBuffer = 64 * 1024
 )
 
+// Sentinel returns the raw prefix which MarshalJSON puts before the key of a Value, unless WithMarker is given.
+func Sentinel() string {
+	return streamPrefix
+}
+
+// SentinelJSON returns the JSON-escaped form of Sentinel, as it appears in encoded JSON strings.
+// It doesn't contain the opening quote.
+// Placeholders are detected only by this exact byte sequence, as encoding/json writes it.
+// Equivalent but different escapings, e.g. \u005c instead of \\ for the backslash, are not detected and written verbatim.
+func SentinelJSON() string {
+	return streamJSONPrefix[1:]
+}
+
 type streamState int
 
 const (
@@ -29,40 +66,342 @@ const (
 // ValueFunc is a callback function, in which you can write large JSON value to w.
 type ValueFunc func(w io.Writer) error
 
+// ValueFuncCtx is a context-aware ValueFunc.
+// ctx is the one given by WithContext, or context.Background() if not given.
+type ValueFuncCtx func(ctx context.Context, w io.Writer) error
+
 // ElementWriter encodes and writes array elements.
 type ElementWriter interface {
 	// WriteElement encodes and writes an array element.
 	WriteElement(e interface{}) error
+
+	// WriteElements encodes and writes es as array elements in order, like WriteElement for each of them.
+	// It stops at the first error, which names the index of the element in the array as WriteElement does.
+	WriteElements(es ...interface{}) error
+
+	// WriteElementTimeout writes an array element produced by produce.
+	// produce is called with a context which is done after d, and when produce doesn't return in time,
+	// null is written instead, or the element is skipped or fails according to WithTimeoutPolicy.
+	// produce runs on its own goroutine, which is left running after the timeout until produce returns,
+	// so produce must return promptly once the context is done not to leak the goroutine.
+	WriteElementTimeout(produce func(ctx context.Context) (interface{}, error), d time.Duration) error
+
+	// WriteNull writes null as an array element.
+	// Unlike WriteElement(nil), it is never skipped by WithSkipNilElements.
+	WriteNull() error
+
+	// WriteRawElement writes raw as an array element verbatim, without encoding it.
+	// raw is validated only when WithCheckRawElements is given.
+	WriteRawElement(raw json.RawMessage) error
+
+	// WriteElementFunc writes an array element streamed by f, so that a large element needn't be marshalled at once.
+	// The element is not passed to the aggregator given by WithElementAggregator.
+	WriteElementFunc(f ValueFunc) error
+
+	// WriteStreamElement writes v streamed by its callback as an array element,
+	// as if its placeholder were written by WriteElement, but without encoding and detecting it.
+	// v must be created by the Writer or its children created by Sub.
+	WriteStreamElement(v *Value) error
+
+	// Count returns the number of the elements written so far, e.g. to cap the array.
+	// Elements skipped by WithSkipNilElements or WriteElementUnique are not counted.
+	Count() int
+
+	// WriteElementUnique writes an array element unless the key extracted by keyFn has already been seen in the array.
+	// The number of the seen keys is limited by WithMaxUniqueKeys.
+	WriteElementUnique(e interface{}, keyFn func(interface{}) string) error
 }
 
 // ArrayValueFunc is a callback function, in which you can write each elements of an array to w.
 type ArrayValueFunc func(w ElementWriter) error
 
 // Writer writes JSON encoded by json.Encoder.
+//
+// A document must be written by a single goroutine, i.e. Write, Encode and Reset must not be called concurrently.
+// The other methods, e.g. registering values, Value.Cancel and Drain, are safe to call concurrently
+// with Write and with each other, unless WithUnsafeNoLock is given.
 type Writer struct {
 	w io.Writer
 	m map[string]*Value
 	sync.Mutex
 
-	// states
-	onString    bool
-	escaping    bool
-	streamState streamState
-	stringBuf   bytes.Buffer
+	// options
+	ctx          context.Context
+	prettyValues bool
+	prettyPrefix string
+	prettyIndent string
+	indentAware  bool // the values are indented according to the depth of the placeholders
+	ttl          time.Duration
+	now          func() time.Time
+	expiries     []*Value
+	bytesPerSec  int
+	burst        int
+	rateLimit    *rateLimitWriter
+
+	expectedValues   int
+	maxReverseBuffer int
+	maxUniqueKeys    int
+	maxMarkerBuffer  int
+	nonce            string // put between the marker and the key of placeholders
+	marker           string // the prefix of placeholders, which is streamPrefix by default
+	markerJSON       string // the encoded form of marker with the opening quote
+	budget           time.Duration
+	deadline         time.Time // the end of budget, which is set on the first Write
+	errorObject      func(key string, err error) interface{}
+	hash             hash.Hash
+	breakers         map[string]CircuitBreaker
+	schema           SchemaValidator
+	skipNilElements  bool
+	unknownKeyPolicy UnknownKeyPolicy
+	timeoutPolicy    TimeoutPolicy
+	compactKeys      bool
+	ids              map[string]*Value // the values by the ids given by WithCompactKeys
+	nextID           int
+	checkRawElements bool
+	validation       bool
+	autoFlush        bool
+	concurrency      int
+	escapeHTML       bool
+	prefetches       map[string]*prefetch // values being rendered concurrently, which is set on the first Write
+	prefetchCtx      context.Context
+	cancelPrefetches context.CancelFunc
+	minify           bool
+	scan             *scanner
+	auditLogger      func(key string)
+	valueHooks       []func(ctx context.Context, key string) func(err error)
+	repair           func(key string, appended string)
+
+	writing bool         // Write is in progress
+	started bool         // Write has been called since New or Reset
+	drains  []chan error // pending Drain calls
+
+	out io.Writer    // the destination of buffered document
+	doc bytes.Buffer // buffered document
+
+	exp *expander // expands placeholders written by Write
+
+	noLock bool // the mutex is not used
+
+	bytesByKey map[string]int64 // the bytes written for each key
+
+	opts []Option  // given to New, which configure the children as well
+	subs []*Writer // children created by Sub
 }
 
 // Value describes future JSON value which is loaded with streaming later.
 type Value struct {
-	key string
-	f   interface{} // ValueFunc or ArrayValueFunc
+	w         *Writer
+	key       string
+	f         interface{} // ValueFunc, ValueFuncCtx, ArrayValueFunc, ObjectValueFunc, MapValueFunc or ndjsonValueFunc
+	expiry    time.Time
+	id        string // the compact reference given by WithCompactKeys
+	canceled  bool
+	fallback  []byte // written in place of the canceled value instead of null
+	skippable bool
+	resolved  bool // the value has been written in place of its placeholder
+	audited   bool // the key has been passed to the audit logger
+	estimate  int64
+
+	// array options
+	aggregator func(e interface{})
+	encoder    func(e interface{}) ([]byte, error)
 }
 
 // New creates new Writer which can be passed to json.NewEncoder.
-func New(w io.Writer) *Writer {
-	return &Writer{
-		w: w,
-		m: map[string]*Value{},
+func New(w io.Writer, opts ...Option) *Writer {
+	wr := newWriter(opts)
+	wr.setOutput(w)
+	return wr
+}
+
+// newWriter creates a Writer configured by opts, whose output is not set yet.
+func newWriter(opts []Option) *Writer {
+	wr := &Writer{
+		ctx:        context.Background(),
+		now:        time.Now,
+		marker:     streamPrefix,
+		markerJSON: streamJSONPrefix,
+
+		maxMarkerBuffer: defaultMaxMarkerBuffer,
+		escapeHTML:      true,
+	}
+	for _, opt := range opts {
+		opt(wr)
+	}
+	wr.m = make(map[string]*Value, wr.expectedValues)
+	if wr.compactKeys {
+		wr.ids = make(map[string]*Value, wr.expectedValues)
+	}
+	wr.opts = opts
+	return wr
+}
+
+// setOutput builds the chain of writers to w according to the options.
+func (w *Writer) setOutput(out io.Writer) {
+	w.w = &outputWriter{w: out}
+	w.rateLimit = nil
+	if w.bytesPerSec > 0 {
+		w.rateLimit = newRateLimitWriter(w.ctx, w.w, w.now, w.bytesPerSec, w.burst)
+		w.w = w.rateLimit
+	}
+	if w.hash != nil {
+		w.w = &hashWriter{w: w.w, h: w.hash}
+	}
+	if w.schema != nil {
+		// the document is buffered until Close.
+		w.out = w.w
+		w.w = &w.doc
 	}
+	if w.minify {
+		w.w = &minifyWriter{w: w.w}
+	}
+	w.exp = w.newExpander(w.ctx, w.w)
+}
+
+// Reset discards all the registered values and the states, and makes w write a new document to out
+// with the same options, so that w can be reused, e.g. with sync.Pool.
+// Values created before Reset are invalidated, and must not be encoded after it.
+// The buffers to detect placeholders are taken from a pool shared by all Writers only while a string is examined,
+// so a reused Writer doesn't hold a large buffer grown by a previous document.
+func (w *Writer) Reset(out io.Writer) {
+	w.lock()
+	defer w.unlock()
+
+	w.m = make(map[string]*Value, w.expectedValues)
+	if w.compactKeys {
+		w.ids = make(map[string]*Value, w.expectedValues)
+		w.nextID = 0
+	}
+	w.subs = nil
+	w.bytesByKey = nil
+	w.expiries = nil
+	w.deadline = time.Time{}
+	w.started = false
+	w.stopPrefetches()
+	w.doc.Reset()
+	if w.hash != nil {
+		w.hash.Reset()
+	}
+	if w.scan != nil {
+		w.scan = &scanner{checkDuplicateKeys: w.scan.checkDuplicateKeys, maxDepth: w.scan.maxDepth}
+	}
+	w.setOutput(out)
+}
+
+// Encode encodes v by json.Encoder configured consistently with the options, e.g. WithIndent, and writes it to w.
+// The streaming states are reset afterward, so that the next document starts cleanly even if encoding fails.
+func (w *Writer) Encode(v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(w.escapeHTML)
+	if w.indentAware {
+		enc.SetIndent(w.prettyPrefix, w.prettyIndent)
+	}
+
+	err := enc.Encode(v)
+
+	w.lock()
+	if err != nil {
+		w.stopPrefetches()
+	}
+	w.exp = w.newExpander(w.ctx, w.w)
+	if w.scan != nil {
+		w.scan = &scanner{checkDuplicateKeys: w.scan.checkDuplicateKeys, maxDepth: w.scan.maxDepth}
+	}
+	w.unlock()
+
+	return err
+}
+
+// UnusedKeys returns the sorted keys of the registered values which have not been written,
+// e.g. because the fields holding them are nil or omitted, or their callbacks failed or were aborted.
+// Call it after encoding to assert every registered value was actually written.
+func (w *Writer) UnusedKeys() []string {
+	w.lock()
+	defer w.unlock()
+
+	var keys []string
+	for key, v := range w.m {
+		if !v.resolved {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// WriteValue writes the value of key to out standalone, as it would be expanded in place of its placeholder,
+// e.g. to test a callback in isolation without encoding a whole document.
+// ErrUnknownKey is returned if key is not registered.
+func (w *Writer) WriteValue(key string, out io.Writer) error {
+	ref := key
+	w.lock()
+	if v, ok := w.m[key]; ok {
+		ref = v.ref()
+	}
+	w.unlock()
+
+	// out is not the destination of w.
+	return w.streamValue(buffered(w.ctx), out, ref, 0)
+}
+
+// Keys returns the sorted keys of the registered values.
+func (w *Writer) Keys() []string {
+	w.lock()
+	defer w.unlock()
+
+	keys := make([]string, 0, len(w.m))
+	for key := range w.m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Validate checks the registered keys for likely mistakes, e.g. of keys built programmatically,
+// and returns ErrInvalidKey describing all of them if any.
+// It reports keys whose placeholders are too long to be detected within WithMaxMarkerBuffer,
+// and keys confusable with each other, which differ only in case or surrounding whitespace.
+// Called after encoding, it reports orphaned keys whose placeholders have not been reached as well, like UnusedKeys.
+func (w *Writer) Validate() error {
+	w.lock()
+	defer w.unlock()
+
+	keys := make([]string, 0, len(w.m))
+	for key := range w.m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []string
+	normalized := map[string]string{}
+	for _, key := range keys {
+		jsn, err := json.Marshal(w.marker + w.nonce + w.m[key].ref())
+		if err != nil {
+			return err
+		}
+		if w.maxMarkerBuffer > 0 && len(jsn) > w.maxMarkerBuffer {
+			problems = append(problems, fmt.Sprintf("%q is too long to be detected", key))
+		}
+
+		n := strings.ToLower(strings.TrimSpace(key))
+		if other, ok := normalized[n]; ok {
+			problems = append(problems, fmt.Sprintf("%q is confusable with %q", key, other))
+		} else {
+			normalized[n] = key
+		}
+
+		if w.started && !w.m[key].resolved {
+			problems = append(problems, fmt.Sprintf("%q is orphaned", key))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidKey, strings.Join(problems, ", "))
+	}
+
+	return nil
 }
 
 // NewValue creates a Value.
@@ -79,152 +418,388 @@ func (w *Writer) MustNewValue(key string, f ValueFunc) *Value {
 	return w.mustNewValue(key, f)
 }
 
-// NewArrayValue creates a Value which describes JSON array.
+// NewValueCtx creates a Value with context-aware callback.
 // key can be any string even empty, but must be unique.
 // error is returned only when duplicate key indicated.
-func (w *Writer) NewArrayValue(key string, f ArrayValueFunc) (*Value, error) {
+func (w *Writer) NewValueCtx(key string, f ValueFuncCtx) (*Value, error) {
 	return w.newValue(key, f)
 }
 
-// MustNewArrayValue creates a Value which describes JSON array.
+// MustNewValueCtx creates a Value with context-aware callback.
 // key can be any string even empty, but must be unique.
 // It panics when duplicate key indicated.
-func (w *Writer) MustNewArrayValue(key string, f ArrayValueFunc) *Value {
+func (w *Writer) MustNewValueCtx(key string, f ValueFuncCtx) *Value {
 	return w.mustNewValue(key, f)
 }
 
-func (w *Writer) newValue(key string, f interface{}) (*Value, error) {
-	w.Lock()
-	defer w.Unlock()
+// NewArrayValue creates a Value which describes JSON array.
+// key can be any string even empty, but must be unique.
+// error is returned only when duplicate key indicated.
+func (w *Writer) NewArrayValue(key string, f ArrayValueFunc, opts ...ArrayOption) (*Value, error) {
+	return w.newValue(key, f, arrayInits(opts)...)
+}
+
+// MustNewArrayValue creates a Value which describes JSON array.
+// key can be any string even empty, but must be unique.
+// It panics when duplicate key indicated.
+func (w *Writer) MustNewArrayValue(key string, f ArrayValueFunc, opts ...ArrayOption) *Value {
+	return w.mustNewValue(key, f, arrayInits(opts)...)
+}
+
+func arrayInits(opts []ArrayOption) []func(v *Value) {
+	inits := make([]func(v *Value), len(opts))
+	for i, opt := range opts {
+		inits[i] = opt
+	}
+	return inits
+}
+
+// newValue registers a new Value. inits are applied to it before it gets registered.
+func (w *Writer) newValue(key string, f interface{}, inits ...func(v *Value)) (*Value, error) {
+	w.lock()
+	defer w.unlock()
+
+	if w.ttl > 0 {
+		w.sweep()
+	}
 
 	if _, ok := w.m[key]; ok {
 		return nil, ErrDuplicateKey
 	}
 
 	v := &Value{
+		w:   w,
 		key: key,
 		f:   f,
 	}
+	for _, init := range inits {
+		init(v)
+	}
 
 	w.m[key] = v
+	if w.compactKeys {
+		v.id = strconv.Itoa(w.nextID)
+		w.nextID++
+		w.ids[v.id] = v
+	}
+
+	if w.ttl > 0 {
+		v.expiry = w.now().Add(w.ttl)
+		w.expiries = append(w.expiries, v)
+	}
 
 	return v, nil
 }
 
-func (w *Writer) mustNewValue(key string, f interface{}) *Value {
-	v, err := w.newValue(key, f)
+// sweep removes expired values. w must be locked.
+// Values are appended to w.expiries in registration order, so they expire in that order too.
+func (w *Writer) sweep() {
+	now := w.now()
+	for len(w.expiries) > 0 && !now.Before(w.expiries[0].expiry) {
+		v := w.expiries[0]
+		if w.m[v.key] == v {
+			delete(w.m, v.key)
+		}
+		delete(w.ids, v.id)
+		w.expiries[0] = nil
+		w.expiries = w.expiries[1:]
+	}
+}
+
+func (w *Writer) mustNewValue(key string, f interface{}, inits ...func(v *Value)) *Value {
+	v, err := w.newValue(key, f, inits...)
 	if err != nil {
 		panic(err)
 	}
 	return v
 }
 
+// Write writes p expanding the placeholders in it. It is called by json.Encoder.
+// n is the number of bytes consumed from p, which doesn't count the bytes of the expanded values.
+// ErrReentrantWrite is returned without writing anything if another Write is in progress,
+// e.g. when a callback writes to the Writer expanding it instead of the io.Writer given to the callback.
 func (w *Writer) Write(p []byte) (n int, err error) {
-	for _, b := range p {
-		if w.onString {
-			if w.escaping {
-				w.escaping = false
-			} else if b == '\\' {
-				w.escaping = true
-			} else if b == '"' {
-				w.onString = false
-			}
+	w.lock()
+	if w.writing {
+		w.unlock()
+		return 0, ErrReentrantWrite
+	}
+	w.writing = true
+	w.started = true
+	if w.budget > 0 && w.deadline.IsZero() {
+		w.deadline = w.now().Add(w.budget)
+	}
+	w.unlock()
 
-			if w.streamState == stateNotValue {
-				_, err := w.w.Write([]byte{b})
-				if err != nil {
-					return n, err
-				}
-			} else {
-				_ = w.stringBuf.WriteByte(b)
-
-				if w.streamState == stateUndetermined {
-					if w.stringBuf.Len() >= len(streamJSONPrefix) {
-						if strings.HasPrefix(w.stringBuf.String(), streamJSONPrefix) {
-							w.streamState = stateValue
-						} else {
-							w.streamState = stateNotValue
-
-							// flush the buffer
-							nn, err := w.w.Write(w.stringBuf.Bytes())
-							n += nn
-							if err != nil {
-								return n, err
-							}
-						}
-					}
+	if w.concurrency > 0 {
+		w.startPrefetches()
+	}
+
+	defer func() {
+		w.lock()
+		w.writing = false
+		if err != nil {
+			w.stopPrefetches()
+		}
+		w.unlock()
+
+		w.safeBoundary()
+	}()
+
+	if w.scan != nil {
+		for i, b := range p {
+			if err := w.scan.step(b); err != nil {
+				// write up to the offending byte.
+				n, werr := w.exp.Write(p[:i])
+				if werr != nil {
+					return n, werr
 				}
+				return n, err
 			}
+		}
+	}
 
-			if !w.onString {
-				// finish string
-				if w.streamState == stateUndetermined {
-					// flush the buffer
-					nn, err := w.w.Write(w.stringBuf.Bytes())
-					n += nn
-					if err != nil {
-						return n, err
-					}
-				} else if w.streamState == stateValue {
-					// process streaming!!
-					var s string
-					if err := json.Unmarshal(w.stringBuf.Bytes(), &s); err != nil {
-						return n, err
-					}
-					key := s[len(streamPrefix):]
-
-					if err := w.streamValue(key); err != nil {
-						return n, err
-					}
-				}
+	return w.exp.Write(p)
+}
+
+// streamValue writes the value of key to out.
+// depth is the nesting depth of the placeholder in the surrounding structure.
+func (w *Writer) streamValue(ctx context.Context, out io.Writer, key string, depth int) error {
+
+	w.lock()
+	v, ok := w.lookup(key)
+	if ok {
+		// key may be the id given by WithCompactKeys.
+		key = v.key
+	}
+	canceled := ok && v.canceled
+	fallback := []byte("null")
+	if canceled && v.fallback != nil {
+		fallback = v.fallback
+	}
+	if ok && v.skippable && !w.deadline.IsZero() && !w.now().Before(w.deadline) {
+		// the time budget is exhausted.
+		canceled = true
+	}
+	w.unlock()
+
+	if !ok {
+		if sub, subKey := w.subFor(key); sub != nil {
+			return sub.streamValue(ctx, out, subKey, depth)
+		}
+		return w.unknownKey(out, key)
+	}
+
+	// don't start any callback once ctx is done, e.g. the client has disconnected.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if canceled {
+		if _, err := out.Write(fallback); err != nil {
+			return err
+		}
+		record(ctx, func() {
+			w.lock()
+			v.resolved = true
+			w.unlock()
+		})
+		return nil
+	}
+
+	if w.auditLogger != nil {
+		record(ctx, func() {
+			w.lock()
+			audited := v.audited
+			v.audited = true
+			w.unlock()
+			if !audited {
+				w.auditLogger(key)
 			}
+		})
+	}
 
-			continue
+	var dones []func(err error)
+	for _, hook := range w.valueHooks {
+		if done := hook(ctx, key); done != nil {
+			dones = append(dones, done)
 		}
+	}
+
+	cw := &countingWriter{w: out}
+	err := w.validateValue(ctx, cw, v, depth)
 
-		// TODO: process only JSON value strings (now process key strings unnecesarily)
-		if b == '"' {
-			// start string
-			w.onString = true
-			w.escaping = false
-			w.streamState = stateUndetermined
-			w.stringBuf.Reset()
-			_ = w.stringBuf.WriteByte('"')
-			continue
+	record(ctx, func() {
+		w.lock()
+		if w.bytesByKey == nil {
+			w.bytesByKey = map[string]int64{}
+		}
+		w.bytesByKey[key] += cw.n
+		if err == nil {
+			// an aborted value stays unused.
+			v.resolved = true
 		}
+		w.unlock()
+	})
 
-		_, err := w.w.Write([]byte{b})
-		if err != nil {
-			return n, err
+	if err != nil {
+		err = fmt.Errorf("streaming value %q: %w", key, err)
+	}
+
+	for i := len(dones) - 1; i >= 0; i-- {
+		dones[i](err)
+	}
+
+	return err
+}
+
+// lookup returns the Value referred by ref, which is the key, or the id if WithCompactKeys is given. w must be locked.
+func (w *Writer) lookup(ref string) (*Value, bool) {
+	if w.compactKeys {
+		v, ok := w.ids[ref]
+		return v, ok
+	}
+	v, ok := w.m[ref]
+	return v, ok
+}
+
+// unknownKey handles the placeholder of unregistered key according to the UnknownKeyPolicy.
+func (w *Writer) unknownKey(out io.Writer, key string) error {
+	switch w.unknownKeyPolicy {
+	case PolicyNull:
+		_, err := out.Write([]byte("null"))
+		return err
+	case PolicySkip:
+		return nil
+	default:
+		return fmt.Errorf("%w: %s", ErrUnknownKey, key)
+	}
+}
+
+// validateValue writes v to out, validating it if WithValidation is given.
+func (w *Writer) validateValue(ctx context.Context, out io.Writer, v *Value, depth int) error {
+	if !w.validation {
+		return w.writeValue(ctx, out, v, depth)
+	}
+
+	vw := &validatingWriter{w: out}
+	if _, ok := v.f.(ndjsonValueFunc); ok {
+		// each line is validated separately.
+		vw.v.lines = true
+	}
+	if err := w.writeValue(ctx, vw, v, depth); err != nil {
+		return err
+	}
+
+	return vw.close()
+}
+
+// writeValue writes v to out, indenting it if WithPrettyValues or WithIndent is given.
+func (w *Writer) writeValue(ctx context.Context, out io.Writer, v *Value, depth int) error {
+	if _, ok := v.f.(ndjsonValueFunc); ok && w.minify {
+		// minifying would strip the line breaks between the elements.
+		return errors.New("NDJSON value can't be minified by WithMinify")
+	}
+
+	if w.prettyValues && ctx.Value(indentingKey{}) == nil {
+		if _, ok := v.f.(ndjsonValueFunc); ok {
+			// indenting would split the elements across lines.
+			return errors.New("NDJSON value can't be indented by WithPrettyValues or WithIndent")
+		}
+
+		prefix := w.prettyPrefix
+		if w.indentAware {
+			prefix += strings.Repeat(w.prettyIndent, depth)
 		}
-		n++
+		out = &indentWriter{w: out, prefix: prefix, indent: w.prettyIndent}
+		ctx = indenting(ctx)
 	}
 
-	return n, nil
+	if ok, err := w.writePrefetched(ctx, out, v.key); ok {
+		return err
+	}
+	return w.expandValue(ctx, out, v)
 }
 
-func (w *Writer) streamValue(key string) error {
+// expandValue writes v to out, repairing it if WithRepair is given.
+func (w *Writer) expandValue(ctx context.Context, out io.Writer, v *Value) error {
+	if w.repair == nil {
+		return w.renderValue(ctx, out, v)
+	}
 
-	v, ok := w.m[key]
-	if !ok {
-		return fmt.Errorf("unexpected key: %s", key)
+	rw := &repairWriter{w: out}
+	if err := w.renderValue(ctx, rw, v); err != nil {
+		return err
 	}
 
+	if closing := rw.closing(); closing != "" {
+		w.repair(v.key, closing)
+		if _, err := out.Write([]byte(closing)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// renderValue runs the callback of v and writes the result to out.
+func (w *Writer) renderValue(ctx context.Context, out io.Writer, v *Value) error {
 	switch f := v.f.(type) {
 	case ValueFunc:
-		if err := f(w.w); err != nil {
-			return err
+		sw := w.newSubsWriter(ctx, out)
+		if err := f(&flushWriter{sw}); err != nil {
+			return sw.omit(err)
+		}
+	case ValueFuncCtx:
+		sw := w.newSubsWriter(ctx, out)
+		if err := f(ctx, &flushWriter{sw}); err != nil {
+			return sw.omit(err)
 		}
 	case ArrayValueFunc:
-		if _, err := w.w.Write([]byte("[")); err != nil {
+		if _, err := out.Write([]byte("[")); err != nil {
 			return err
 		}
 
-		if err := f(&elementWriter{w: w.w}); err != nil {
+		ew := w.newElementWriter(ctx, out)
+		ew.aggregator = v.aggregator
+		ew.encoder = v.encoder
+		if err := f(ew); err != nil {
 			return err
 		}
 
-		if _, err := w.w.Write([]byte("]")); err != nil {
+		if _, err := out.Write([]byte("]")); err != nil {
+			return err
+		}
+	case ndjsonValueFunc:
+		ew := w.newElementWriter(ctx, out)
+		ew.aggregator = v.aggregator
+		ew.encoder = v.encoder
+		ew.lines = true
+		if err := f(ew); err != nil {
+			return err
+		}
+	case ObjectValueFunc:
+		if _, err := out.Write([]byte("{")); err != nil {
+			return err
+		}
+
+		if err := f(&objectWriter{parent: w, ctx: ctx, w: out}); err != nil {
+			return err
+		}
+
+		if _, err := out.Write([]byte("}")); err != nil {
+			return err
+		}
+	case MapValueFunc:
+		if _, err := out.Write([]byte("{")); err != nil {
+			return err
+		}
+
+		if err := f(&mapWriter{parent: w, ctx: ctx, w: out}); err != nil {
+			return err
+		}
+
+		if _, err := out.Write([]byte("}")); err != nil {
 			return err
 		}
 	default:
@@ -234,35 +809,433 @@ func (w *Writer) streamValue(key string) error {
 	return nil
 }
 
+// Flusher is implemented by the io.Writer passed to ValueFunc and ValueFuncCtx.
+// Callbacks can flush the destination at their own boundaries by asserting it.
+type Flusher interface {
+	// Flush flushes the destination if it is flushable.
+	Flush() error
+}
+
+type flushWriter struct {
+	io.Writer
+}
+
+// Flush flushes the underlying writer.
+// It does nothing for buffering modes like WithPrettyValues, in which the underlying writer is a buffer.
+func (fw *flushWriter) Flush() error {
+	return flush(fw.Writer)
+}
+
+// flush flushes w if it implements Flusher or http.Flusher.
+// Writers wrapping the destination implement Flusher to pass it through.
+func flush(w io.Writer) error {
+	switch f := w.(type) {
+	case Flusher:
+		return f.Flush()
+	case interface{ Flush() }:
+		f.Flush()
+	}
+	return nil
+}
+
 type elementWriter struct {
-	w         io.Writer
-	following bool
+	parent     *Writer
+	w          io.Writer
+	ctx        context.Context
+	skipNil    bool
+	aggregator func(e interface{})
+	encoder    func(e interface{}) ([]byte, error)
+	lines      bool                // elements are separated by newlines instead of commas
+	n          int                 // the number of the elements started, which is the index of the next one
+	seen       map[string]struct{} // keys written by WriteElementUnique
+	buf        []byte              // reused to encode primitive elements
+	x          *expander           // reused to expand elements, which is back in the initial states after each element
+}
+
+func (w *Writer) newElementWriter(ctx context.Context, out io.Writer) *elementWriter {
+	return &elementWriter{
+		parent:  w,
+		w:       out,
+		ctx:     ctx,
+		skipNil: w.skipNilElements,
+	}
 }
 
 func (ew *elementWriter) WriteElement(e interface{}) error {
+	i := ew.n
+	return elementError(i, ew.writeElement(e))
+}
 
-	if ew.following {
-		if _, err := ew.w.Write([]byte(",")); err != nil {
+func (ew *elementWriter) writeElement(e interface{}) error {
+	if ew.skipNil && isNil(e) {
+		return nil
+	}
+
+	// encoded before the separator, so that a failed element leaves no dangling separator.
+	var jsn []byte
+	var primitive bool
+	if ew.encoder == nil {
+		jsn, primitive = appendPrimitive(ew.buf[:0], e)
+	}
+	if primitive {
+		ew.buf = jsn
+	} else {
+		var err error
+		jsn, err = ew.encode(e)
+		if err != nil {
 			return err
 		}
-	} else {
-		ew.following = true
 	}
 
-	// Now Value in the e is not supported, and the key will directly marshalled.
-	jsn, err := json.Marshal(e)
-	if err != nil {
+	if err := ew.writeSeparator(); err != nil {
+		return err
+	}
+
+	// only strings can be placeholders.
+	if _, isString := e.(string); primitive && !isString {
+		if _, err := ew.w.Write(jsn); err != nil {
+			return err
+		}
+		return ew.written(e)
+	}
+
+	// Values in e are expanded as well as the top-level ones.
+	if ew.x == nil {
+		ew.x = ew.parent.newExpander(ew.ctx, ew.w)
+	}
+	if _, err := ew.x.Write(jsn); err != nil {
+		return err
+	}
+
+	return ew.written(e)
+}
+
+func (ew *elementWriter) WriteElements(es ...interface{}) error {
+	for _, e := range es {
+		// the error names the index of the element by WriteElement.
+		if err := ew.WriteElement(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (ew *elementWriter) WriteRawElement(raw json.RawMessage) error {
+	i := ew.n
+	return elementError(i, ew.writeRawElement(raw))
+}
+
+func (ew *elementWriter) writeRawElement(raw json.RawMessage) error {
+	if ew.parent.checkRawElements && !json.Valid(raw) {
+		return fmt.Errorf("invalid raw element: %s", raw)
+	}
+
+	if err := ew.writeSeparator(); err != nil {
+		return err
+	}
+
+	if _, err := ew.w.Write(raw); err != nil {
+		return err
+	}
+
+	return ew.written(raw)
+}
+
+func (ew *elementWriter) WriteElementFunc(f ValueFunc) error {
+	i := ew.n
+	return elementError(i, ew.writeElementFunc(f))
+}
+
+func (ew *elementWriter) writeElementFunc(f ValueFunc) error {
+	if err := ew.writeSeparator(); err != nil {
+		return err
+	}
+
+	sw := ew.parent.newSubsWriter(ew.ctx, ew.w)
+	if err := f(&flushWriter{sw}); err != nil {
+		if err := sw.omit(err); err != nil {
+			return err
+		}
+	}
+
+	return ew.parent.valueBoundary(ew.ctx)
+}
+
+func (ew *elementWriter) WriteStreamElement(v *Value) error {
+	i := ew.n
+	return elementError(i, ew.writeStreamElement(v))
+}
+
+func (ew *elementWriter) writeStreamElement(v *Value) error {
+	key, ok := ew.parent.keyOf(v)
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownKey, v.key)
+	}
+
+	if err := ew.writeSeparator(); err != nil {
+		return err
+	}
+
+	if err := ew.parent.streamValue(ew.ctx, ew.w, key, 0); err != nil {
+		return err
+	}
+
+	return ew.parent.valueBoundary(ew.ctx)
+}
+
+func (ew *elementWriter) WriteNull() error {
+	i := ew.n
+	return elementError(i, ew.writeNull())
+}
+
+func (ew *elementWriter) writeNull() error {
+	if err := ew.writeSeparator(); err != nil {
 		return err
 	}
 
-	if _, err := ew.w.Write(jsn); err != nil {
+	if _, err := ew.w.Write([]byte("null")); err != nil {
 		return err
 	}
 
+	return ew.written(nil)
+}
+
+func (ew *elementWriter) WriteElementUnique(e interface{}, keyFn func(interface{}) string) error {
+	i := ew.n
+	key := keyFn(e)
+	if _, ok := ew.seen[key]; ok {
+		return nil
+	}
+
+	if max := ew.parent.maxUniqueKeys; max > 0 && len(ew.seen) >= max {
+		return elementError(i, ErrBufferLimitExceeded)
+	}
+
+	if err := ew.writeElement(e); err != nil {
+		return elementError(i, err)
+	}
+
+	// seen only once written, so that a failed element can be written again.
+	if ew.seen == nil {
+		ew.seen = map[string]struct{}{}
+	}
+	ew.seen[key] = struct{}{}
+
+	return nil
+}
+
+// writeRendered writes raw, an element already encoded and expanded, without expanding it again.
+// e is passed to the aggregator only if aggregate is true, i.e. raw was rendered from e by WriteElement or the like.
+func (ew *elementWriter) writeRendered(raw json.RawMessage, e interface{}, aggregate bool) error {
+	if err := ew.writeSeparator(); err != nil {
+		return err
+	}
+
+	if _, err := ew.w.Write(raw); err != nil {
+		return err
+	}
+
+	if aggregate && ew.aggregator != nil {
+		ew.aggregator(e)
+	}
+	return ew.parent.valueBoundary(ew.ctx)
+}
+
+// written is called after each element e is written.
+func (ew *elementWriter) written(e interface{}) error {
+	if ew.aggregator != nil {
+		ew.aggregator(e)
+	}
+
+	return ew.parent.valueBoundary(ew.ctx)
+}
+
+// marshal encodes v like json.Marshal, escaping HTML characters only if w.escapeHTML is true.
+func (w *Writer) marshal(v interface{}) ([]byte, error) {
+	if w.escapeHTML {
+		return json.Marshal(v)
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+
+	// trim the newline put by Encode.
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// valueBoundary is called at the end of each streamed value, array element and object member.
+// Nothing is done if ctx is for buffered output, which is not written to the destination yet.
+func (w *Writer) valueBoundary(ctx context.Context) error {
+	if ctx.Value(bufferedKey{}) != nil {
+		return nil
+	}
+
+	if w.autoFlush {
+		if err := flush(w.w); err != nil {
+			return err
+		}
+	}
+
+	// each of them is a safe boundary for Drain.
+	w.safeBoundary()
+
+	return nil
+}
+
+// encode encodes e by the encoder given by WithElementEncoder, or like json.Marshal by default.
+func (ew *elementWriter) encode(e interface{}) ([]byte, error) {
+	if ew.encoder != nil {
+		return ew.encoder(e)
+	}
+	return ew.parent.marshal(e)
+}
+
+func (ew *elementWriter) Count() int {
+	return ew.n
+}
+
+// elementError wraps err with the index i of the element in the array, so that the failing element can be told.
+// It returns nil if err is nil.
+func elementError(i int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("element %d: %w", i, err)
+}
+
+// writeSeparator writes comma before the element if it is not the first one.
+func (ew *elementWriter) writeSeparator() error {
+	if ew.n > 0 {
+		sep := []byte(",")
+		if ew.lines {
+			sep = []byte("\n")
+		}
+		if _, err := ew.w.Write(sep); err != nil {
+			return err
+		}
+	}
+	ew.n++
 	return nil
 }
 
+// isNil reports whether e is nil or a nil pointer, map, slice or interface.
+func isNil(e interface{}) bool {
+	if e == nil {
+		return true
+	}
+	switch v := reflect.ValueOf(e); v.Kind() {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
+
+func (ew *elementWriter) WriteElementTimeout(produce func(ctx context.Context) (interface{}, error), d time.Duration) error {
+	ctx, cancel := context.WithTimeout(ew.ctx, d)
+	defer cancel()
+
+	type result struct {
+		e   interface{}
+		err error
+	}
+
+	// buffered so that the goroutine can finish even after timeout.
+	ch := make(chan result, 1)
+	go func() {
+		e, err := produce(ctx)
+		ch <- result{e: e, err: err}
+	}()
+
+	select {
+	case r := <-ch:
+		if r.err == nil {
+			return ew.WriteElement(r.e)
+		}
+		if ctx.Err() == nil || ew.ctx.Err() != nil {
+			return r.err
+		}
+	case <-ctx.Done():
+		if err := ew.ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	// timed out
+	switch ew.parent.timeoutPolicy {
+	case TimeoutSkip:
+		return nil
+	case TimeoutError:
+		return elementError(ew.n, context.DeadlineExceeded)
+	default:
+		return ew.WriteNull()
+	}
+}
+
+// Cancel marks v as canceled, so that null is written instead of running the callback when its placeholder is reached.
+// It has no effect if the placeholder has already been reached, or if a worker of WithConcurrency has started the callback,
+// in which case the rendered bytes are discarded.
+func (v *Value) Cancel() {
+	v.w.lock()
+	defer v.w.unlock()
+
+	v.canceled = true
+}
+
+// CancelWith marks v as canceled like Cancel, but fallback is written verbatim instead of null.
+// fallback must be valid JSON, and must not be modified afterward.
+func (v *Value) CancelWith(fallback json.RawMessage) {
+	v.w.lock()
+	defer v.w.unlock()
+
+	v.canceled = true
+	v.fallback = fallback
+}
+
+// MarkSkippable marks v as skippable, so that null is written instead of running the callback
+// when the time budget given by WithTimeBudget is exhausted. It returns v for convenience.
+// Values not marked are always expanded regardless of the budget.
+func (v *Value) MarkSkippable() *Value {
+	v.w.lock()
+	defer v.w.unlock()
+
+	v.skippable = true
+	return v
+}
+
 // MarshalJSON implements json.Marshaler interface but it puts placeholder for delay encoding.
 func (v *Value) MarshalJSON() ([]byte, error) {
-	return json.Marshal(streamPrefix + v.key)
+	return json.Marshal(v.w.marker + v.w.nonce + v.ref())
+}
+
+// ref returns the reference to v put in its placeholder, which is the id if WithCompactKeys is given, or the key.
+func (v *Value) ref() string {
+	if v.id != "" {
+		return v.id
+	}
+	return v.key
+}
+
+// lock locks w unless WithUnsafeNoLock is given.
+func (w *Writer) lock() {
+	if !w.noLock {
+		w.Lock()
+	}
+}
+
+// unlock unlocks w unless WithUnsafeNoLock is given.
+func (w *Writer) unlock() {
+	if !w.noLock {
+		w.Unlock()
+	}
+}
+
+type bufferedKey struct{}
+
+// buffered returns ctx for rendering values into a buffer, which is not written to the destination yet.
+func buffered(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bufferedKey{}, true)
 }
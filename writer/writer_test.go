@@ -2,11 +2,16 @@ package writer_test
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/knightso/json-partial-streaming/writer"
 )
@@ -229,3 +234,1130 @@ func TestMarshalJSONEscaping(t *testing.T) {
 		t.Errorf("MarshalJSON failed. expected %s but was %s", expected, actual)
 	}
 }
+
+func TestSentinel(t *testing.T) {
+	w := writer.New(ioutil.Discard)
+
+	v := w.MustNewValue("testkey", func(w io.Writer) error {
+		return nil
+	})
+
+	b, err := v.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `"`+writer.SentinelJSON()+"testkey"+`"`, string(b); expected != actual {
+		t.Errorf("SentinelJSON mismatch. expected %s but was %s", expected, actual)
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := writer.Sentinel()+"testkey", s; expected != actual {
+		t.Errorf("Sentinel mismatch. expected %s but was %s", expected, actual)
+	}
+}
+
+func TestWriteElementTimeout(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	root := struct {
+		Array *writer.Value
+	}{
+		Array: w.MustNewArrayValue("array", func(w writer.ElementWriter) error {
+			if err := w.WriteElementTimeout(func(ctx context.Context) (interface{}, error) {
+				return 1, nil
+			}, time.Second); err != nil {
+				return err
+			}
+			if err := w.WriteElementTimeout(func(ctx context.Context) (interface{}, error) {
+				<-ctx.Done()
+				time.Sleep(10 * time.Millisecond)
+				return 2, nil
+			}, 10*time.Millisecond); err != nil {
+				return err
+			}
+			return w.WriteElement(3)
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"Array":[1,null,3]}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWriteElementTimeoutPolicy(t *testing.T) {
+	slow := func(ctx context.Context) (interface{}, error) {
+		<-ctx.Done()
+		return 2, nil
+	}
+
+	for _, test := range []struct {
+		policy   writer.TimeoutPolicy
+		expected string
+		err      bool
+	}{
+		{policy: writer.TimeoutNull, expected: `[1,null,3]`},
+		{policy: writer.TimeoutSkip, expected: `[1,3]`},
+		{policy: writer.TimeoutError, err: true},
+	} {
+		buf := new(bytes.Buffer)
+		w := writer.New(buf, writer.WithTimeoutPolicy(test.policy))
+
+		v := w.MustNewArrayValue("array", func(w writer.ElementWriter) error {
+			if err := w.WriteElement(1); err != nil {
+				return err
+			}
+			if err := w.WriteElementTimeout(slow, 10*time.Millisecond); err != nil {
+				return err
+			}
+			return w.WriteElement(3)
+		})
+
+		err := w.Encode(v)
+		if test.err {
+			if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "element 1:") {
+				t.Errorf("policy %d: context.DeadlineExceeded of element 1 expected, but was %v", test.policy, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := test.expected+"\n", buf.String(); actual != expected {
+			t.Errorf("policy %d: result expected:%s, but was %s", test.policy, expected, actual)
+		}
+	}
+}
+
+type flushRecorder struct {
+	bytes.Buffer
+	flushed []string
+}
+
+func (fr *flushRecorder) Flush() error {
+	fr.flushed = append(fr.flushed, fr.String())
+	return nil
+}
+
+func TestFlush(t *testing.T) {
+	out := new(flushRecorder)
+	w := writer.New(out)
+
+	root := struct {
+		Values *writer.Value
+	}{
+		Values: w.MustNewValue("values", func(w io.Writer) error {
+			f, ok := w.(writer.Flusher)
+			if !ok {
+				return fmt.Errorf("%T is not a Flusher", w)
+			}
+			if _, err := w.Write([]byte("[1")); err != nil {
+				return err
+			}
+			if err := f.Flush(); err != nil {
+				return err
+			}
+			if _, err := w.Write([]byte(",2]")); err != nil {
+				return err
+			}
+			return f.Flush()
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := 2, len(out.flushed); actual != expected {
+		t.Fatalf("flush count expected:%d, but was %d", expected, actual)
+	}
+	if expected, actual := `{"Values":[1`, out.flushed[0]; actual != expected {
+		t.Errorf("first flush expected:%s, but was %s", expected, actual)
+	}
+	if expected, actual := `{"Values":[1,2]`, out.flushed[1]; actual != expected {
+		t.Errorf("second flush expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	var called bool
+	root := struct {
+		Canceled *writer.Value
+		Alive    *writer.Value
+	}{
+		Canceled: w.MustNewValue("canceled", func(w io.Writer) error {
+			called = true
+			_, err := w.Write([]byte("1"))
+			return err
+		}),
+		Alive: w.MustNewValue("alive", func(w io.Writer) error {
+			_, err := w.Write([]byte("2"))
+			return err
+		}),
+	}
+
+	root.Canceled.Cancel()
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if called {
+		t.Error("callback of canceled value must not be called")
+	}
+	if expected, actual := `{"Canceled":null,"Alive":2}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestCancelWith(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	var called bool
+	v := w.MustNewArrayValue("items", func(w writer.ElementWriter) error {
+		called = true
+		return w.WriteElement(1)
+	})
+
+	v.CancelWith(json.RawMessage(`[]`))
+
+	if err := json.NewEncoder(w).Encode(map[string]*writer.Value{"items": v}); err != nil {
+		t.Fatal(err)
+	}
+
+	if called {
+		t.Error("callback of canceled value must not be called")
+	}
+	if expected, actual := `{"items":[]}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWriteNull(t *testing.T) {
+	type Item struct {
+		ID int
+	}
+
+	f := func(w writer.ElementWriter) error {
+		var nilItem *Item
+		for _, e := range []interface{}{&Item{ID: 1}, nil, nilItem, &Item{ID: 4}} {
+			if err := w.WriteElement(e); err != nil {
+				return err
+			}
+		}
+		if err := w.WriteNull(); err != nil {
+			return err
+		}
+		return w.WriteElement(&Item{ID: 6})
+	}
+
+	for _, test := range []struct {
+		opts     []writer.Option
+		expected string
+	}{
+		{
+			expected: `{"Items":[{"ID":1},null,null,{"ID":4},null,{"ID":6}]}` + "\n",
+		},
+		{
+			opts:     []writer.Option{writer.WithSkipNilElements()},
+			expected: `{"Items":[{"ID":1},{"ID":4},null,{"ID":6}]}` + "\n",
+		},
+	} {
+		buf := new(bytes.Buffer)
+		w := writer.New(buf, test.opts...)
+
+		root := struct {
+			Items *writer.Value
+		}{
+			Items: w.MustNewArrayValue("items", f),
+		}
+
+		if err := json.NewEncoder(w).Encode(&root); err != nil {
+			t.Fatal(err)
+		}
+
+		if actual := buf.String(); actual != test.expected {
+			t.Errorf("result expected:%s, but was %s", test.expected, actual)
+		}
+	}
+}
+
+func TestWriteElementUnique(t *testing.T) {
+	type Record struct {
+		ID   int
+		Name string
+	}
+
+	records := []*Record{
+		{ID: 1, Name: "a"},
+		{ID: 2, Name: "b"},
+		{ID: 1, Name: "c"},
+		{ID: 3, Name: "d"},
+		{ID: 2, Name: "e"},
+	}
+	f := func(w writer.ElementWriter) error {
+		for _, r := range records {
+			if err := w.WriteElementUnique(r, func(e interface{}) string {
+				return fmt.Sprint(e.(*Record).ID)
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	root := struct {
+		Records *writer.Value
+	}{
+		Records: w.MustNewArrayValue("records", f),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Records":[{"ID":1,"Name":"a"},{"ID":2,"Name":"b"},{"ID":3,"Name":"d"}]}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+
+	// 3 unique keys exceed the limit.
+	w = writer.New(new(bytes.Buffer), writer.WithMaxUniqueKeys(2))
+
+	root.Records = w.MustNewArrayValue("records", f)
+
+	if err := json.NewEncoder(w).Encode(&root); !errors.Is(err, writer.ErrBufferLimitExceeded) {
+		t.Fatalf("ErrBufferLimitExceeded expected, but was %v", err)
+	}
+}
+
+func TestWriteElementUniqueFailed(t *testing.T) {
+	type Record struct {
+		ID   int
+		Name interface{}
+	}
+
+	keyFn := func(e interface{}) string {
+		return fmt.Sprint(e.(*Record).ID)
+	}
+
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithMaxUniqueKeys(1))
+
+	root := struct {
+		Records *writer.Value
+	}{
+		Records: w.MustNewArrayValue("records", func(w writer.ElementWriter) error {
+			// a channel can't be encoded.
+			failing := &Record{ID: 1, Name: make(chan int)}
+			if err := w.WriteElementUnique(failing, keyFn); err == nil {
+				return errors.New("error expected for the failing element")
+			}
+
+			// the key of the failed element is not seen.
+			if err := w.WriteElementUnique(&Record{ID: 1, Name: "a"}, keyFn); err != nil {
+				return err
+			}
+
+			return w.WriteElementUnique(&Record{ID: 2, Name: "b"}, keyFn)
+		}),
+	}
+
+	err := json.NewEncoder(w).Encode(&root)
+	if !errors.Is(err, writer.ErrBufferLimitExceeded) {
+		t.Fatalf("ErrBufferLimitExceeded expected, but was %v", err)
+	}
+	if !strings.Contains(err.Error(), "element 1") {
+		t.Fatalf("error must name the element index, but was %v", err)
+	}
+
+	expected := `{"Records":[{"ID":1,"Name":"a"}`
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWriteElementNestedValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	type Item struct {
+		ID      int
+		Details *writer.Value
+	}
+
+	root := struct {
+		Items *writer.Value
+	}{
+		Items: w.MustNewArrayValue("items", func(ew writer.ElementWriter) error {
+			for i := 1; i <= 2; i++ {
+				i := i
+				item := &Item{
+					ID: i,
+					Details: w.MustNewArrayValue(fmt.Sprintf("items[%d].details", i), func(ew writer.ElementWriter) error {
+						return ew.WriteElement(fmt.Sprintf("detail%d", i))
+					}),
+				}
+				if err := ew.WriteElement(item); err != nil {
+					return err
+				}
+			}
+			return ew.WriteElement(w.MustNewValue("items[3]", func(w io.Writer) error {
+				_, err := w.Write([]byte(`"direct"`))
+				return err
+			}))
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Items":[{"ID":1,"Details":["detail1"]},{"ID":2,"Details":["detail2"]},"direct"]}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWriteStreamElement(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithNonce())
+	sub := w.Sub()
+
+	var objects []*writer.Value
+	for i := 0; i < 3; i++ {
+		i := i
+		objects = append(objects, w.MustNewObjectValue(fmt.Sprintf("object%d", i), func(w writer.ObjectWriter) error {
+			return w.WriteMember("ID", i)
+		}))
+	}
+	objects = append(objects, sub.MustNewMapValue("object0", func(w writer.MapWriter) error {
+		return w.WriteEntry("ID", func(w io.Writer) error {
+			_, err := w.Write([]byte("3"))
+			return err
+		})
+	}))
+
+	v := w.MustNewArrayValue("objects", func(w writer.ElementWriter) error {
+		for _, o := range objects {
+			if err := w.WriteStreamElement(o); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `[{"ID":0},{"ID":1},{"ID":2},{"ID":3}]` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+
+	// a value of another Writer.
+	other := writer.New(ioutil.Discard, writer.WithNonce())
+	v = w.MustNewArrayValue("other", func(w writer.ElementWriter) error {
+		return w.WriteStreamElement(other.MustNewValue("other", func(w io.Writer) error { return nil }))
+	})
+
+	if err := json.NewEncoder(w).Encode(v); !errors.Is(err, writer.ErrUnknownKey) {
+		t.Fatalf("ErrUnknownKey expected, but was %v", err)
+	}
+}
+
+func TestWritePlaceholderLikeKey(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	root := map[string]interface{}{
+		writer.Sentinel() + "key": w.MustNewValue("key", func(w io.Writer) error {
+			_, err := w.Write([]byte("1"))
+			return err
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `{"`+writer.SentinelJSON()+`key":1}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+type benchNode struct {
+	ID       int
+	Name     string
+	Active   bool
+	Children []*benchNode
+}
+
+func newBenchNode(depth int) *benchNode {
+	n := &benchNode{ID: depth, Name: fmt.Sprintf("node%d", depth), Active: depth%2 == 0}
+	if depth > 0 {
+		for i := 0; i < 3; i++ {
+			n.Children = append(n.Children, newBenchNode(depth-1))
+		}
+	}
+	return n
+}
+
+func BenchmarkWriteNested(b *testing.B) {
+	root := newBenchNode(7)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		w := writer.New(ioutil.Discard)
+		if err := json.NewEncoder(w).Encode(root); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestWriteEscapedKeys(t *testing.T) {
+	keys := []string{
+		"plain",
+		`\test"key"`,
+		"tab\tnew\nline\r/",
+		"<html>&",
+		" \x01",
+		"日本語🎏",
+	}
+
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	var values []*writer.Value
+	for i, key := range keys {
+		i := i
+		values = append(values, w.MustNewValue(key, func(w io.Writer) error {
+			_, err := fmt.Fprint(w, i)
+			return err
+		}))
+	}
+
+	if err := json.NewEncoder(w).Encode(values); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := "[0,1,2,3,4,5]\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestReset(t *testing.T) {
+	buf1 := new(bytes.Buffer)
+	w := writer.New(buf1)
+
+	f := func(n int) writer.ValueFunc {
+		return func(w io.Writer) error {
+			_, err := fmt.Fprint(w, n)
+			return err
+		}
+	}
+
+	// a document is left unfinished.
+	if _, err := w.Write([]byte(`{"A":"\\`)); err != nil {
+		t.Fatal(err)
+	}
+
+	buf2 := new(bytes.Buffer)
+	w.Reset(buf2)
+
+	// the same key can be registered again.
+	root := struct {
+		A *writer.Value
+	}{
+		A: w.MustNewValue("a", f(2)),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	// the string being buffered is discarded.
+	if expected, actual := `{"A":`, buf1.String(); actual != expected {
+		t.Errorf("first result expected:%s, but was %s", expected, actual)
+	}
+	if expected, actual := `{"A":2}`+"\n", buf2.String(); actual != expected {
+		t.Errorf("second result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWriteRawElement(t *testing.T) {
+	f := func(w writer.ElementWriter) error {
+		if err := w.WriteElement(1); err != nil {
+			return err
+		}
+		if err := w.WriteRawElement(json.RawMessage(`{"cached":true}`)); err != nil {
+			return err
+		}
+		return w.WriteRawElement(json.RawMessage(`{"broken":`))
+	}
+
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	root := struct {
+		Items *writer.Value
+	}{
+		Items: w.MustNewArrayValue("items", f),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	// written verbatim without the check.
+	if expected, actual := `{"Items":[1,{"cached":true},{"broken":]}`+"\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+
+	w = writer.New(new(bytes.Buffer), writer.WithCheckRawElements())
+	root.Items = w.MustNewArrayValue("items", f)
+
+	if err := json.NewEncoder(w).Encode(&root); err == nil {
+		t.Fatal("error expected")
+	}
+}
+
+func TestUnusedKeys(t *testing.T) {
+	w := writer.New(new(bytes.Buffer))
+
+	f := func(w io.Writer) error {
+		_, err := w.Write([]byte("1"))
+		return err
+	}
+
+	root := struct {
+		A        *writer.Value
+		B        *writer.Value `json:"-"`
+		Canceled *writer.Value
+	}{
+		A:        w.MustNewValue("a", f),
+		B:        w.MustNewValue("b", f),
+		Canceled: w.MustNewValue("canceled", f),
+	}
+	w.MustNewValue("c", f)
+	root.Canceled.Cancel()
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `["b","c"]`, mustMarshal(t, w.UnusedKeys()); actual != expected {
+		t.Fatalf("unused keys expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestUnusedKeysAborted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := writer.New(new(bytes.Buffer), writer.WithContext(ctx))
+
+	a := w.MustNewValue("a", func(w io.Writer) error {
+		cancel()
+		_, err := w.Write([]byte("1"))
+		return err
+	})
+	b := w.MustNewValue("b", func(w io.Writer) error {
+		_, err := w.Write([]byte("2"))
+		return err
+	})
+
+	if err := w.Encode([]*writer.Value{a, b}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("context.Canceled expected, but was %v", err)
+	}
+
+	if expected, actual := `["b"]`, mustMarshal(t, w.UnusedKeys()); actual != expected {
+		t.Fatalf("unused keys expected:%s, but was %s", expected, actual)
+	}
+	if err := w.Validate(); err == nil || !strings.Contains(err.Error(), `"b" is orphaned`) {
+		t.Fatalf("b expected to be orphaned, but was %v", err)
+	}
+}
+
+func TestWriteValue(t *testing.T) {
+	w := writer.New(ioutil.Discard)
+
+	w.MustNewArrayValue("array", func(w writer.ElementWriter) error {
+		return w.WriteElements(1, "two")
+	})
+
+	buf := new(bytes.Buffer)
+	if err := w.WriteValue("array", buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := `[1,"two"]`, buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+
+	if err := w.WriteValue("unknown", buf); !errors.Is(err, writer.ErrUnknownKey) {
+		t.Fatalf("ErrUnknownKey expected, but was %v", err)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	w := writer.New(ioutil.Discard)
+
+	for _, key := range []string{"b", "c", "a"} {
+		w.MustNewValue(key, func(w io.Writer) error { return nil })
+	}
+
+	if expected, actual := []string{"a", "b", "c"}, w.Keys(); !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("keys expected:%v, but was %v", expected, actual)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	w := writer.New(ioutil.Discard, writer.WithMaxMarkerBuffer(64))
+
+	f := func(w io.Writer) error {
+		_, err := w.Write([]byte("null"))
+		return err
+	}
+	for i := 0; i < 3; i++ {
+		w.MustNewValue(fmt.Sprintf("$.Child[%d].Values", i), f)
+	}
+	if err := w.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	w.MustNewValue("$.child[1].Values ", f)
+	w.MustNewValue(strings.Repeat("long", 16), f)
+
+	err := w.Validate()
+	if !errors.Is(err, writer.ErrInvalidKey) {
+		t.Fatalf("ErrInvalidKey expected, but was %v", err)
+	}
+	for _, expected := range []string{
+		`"$.child[1].Values " is confusable with "$.Child[1].Values"`,
+		`"longlonglonglonglonglonglonglonglonglonglonglonglonglonglonglong" is too long to be detected`,
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("error expected to contain %s, but was %s", expected, err)
+		}
+	}
+
+	// orphaned keys are reported after encoding.
+	w = writer.New(ioutil.Discard)
+	used := w.MustNewValue("used", f)
+	w.MustNewValue("orphan", f)
+
+	if err := json.NewEncoder(w).Encode(used); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, err := `invalid key: "orphan" is orphaned`, w.Validate(); err == nil || err.Error() != expected {
+		t.Fatalf("error expected:%s, but was %v", expected, err)
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	errCallback := errors.New("callback failed")
+
+	w := writer.New(new(bytes.Buffer))
+	root := struct {
+		Array *writer.Value
+	}{
+		Array: w.MustNewArrayValue("array", func(w writer.ElementWriter) error {
+			return errCallback
+		}),
+	}
+
+	err := json.NewEncoder(w).Encode(&root)
+	if !errors.Is(err, errCallback) {
+		t.Fatalf("%v expected, but was %v", errCallback, err)
+	}
+	if expected, actual := `streaming value "array": callback failed`, err.Error(); !strings.Contains(actual, expected) {
+		t.Errorf("error expected to contain %s, but was %s", expected, actual)
+	}
+
+	// a placeholder of another Writer.
+	other := writer.New(ioutil.Discard)
+	root.Array = other.MustNewValue("unknown", func(w io.Writer) error { return nil })
+
+	if err := json.NewEncoder(w).Encode(&root); !errors.Is(err, writer.ErrUnknownKey) {
+		t.Fatalf("ErrUnknownKey expected, but was %v", err)
+	}
+}
+
+func TestWriteCount(t *testing.T) {
+	w := writer.New(ioutil.Discard)
+
+	v := w.MustNewArrayValue("array", func(w writer.ElementWriter) error {
+		return w.WriteElement("expanded")
+	})
+	jsn, err := json.Marshal(map[string]interface{}{"key": "value", "array": v, "number": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// split in the middle of the placeholder.
+	i := bytes.Index(jsn, []byte(writer.SentinelJSON())) + 3
+	for _, p := range [][]byte{jsn[:i], jsn[i:]} {
+		n, err := w.Write(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(p) {
+			t.Errorf("written bytes expected:%d, but was %d", len(p), n)
+		}
+	}
+}
+
+func TestWriteReentrant(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	inner := w.MustNewValue("inner", func(w io.Writer) error {
+		_, err := w.Write([]byte(`"inner"`))
+		return err
+	})
+	outer := w.MustNewValue("outer", func(io.Writer) error {
+		// mistakenly writes to the Writer itself, which would clobber the states in the middle of the placeholder.
+		return json.NewEncoder(w).Encode(inner)
+	})
+
+	err := json.NewEncoder(w).Encode([]*writer.Value{outer})
+	if !errors.Is(err, writer.ErrReentrantWrite) {
+		t.Fatalf("ErrReentrantWrite expected, but was %v", err)
+	}
+
+	// nothing is written by the reentrant Write.
+	expected := `[`
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestOmitValue(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	root := struct {
+		Omitted    *writer.Value
+		OmittedCtx *writer.Value
+		Array      *writer.Value
+	}{
+		Omitted: w.MustNewValue("omitted", func(w io.Writer) error {
+			return writer.ErrOmitValue
+		}),
+		OmittedCtx: w.MustNewValueCtx("omittedCtx", func(ctx context.Context, w io.Writer) error {
+			return fmt.Errorf("not found: %w", writer.ErrOmitValue)
+		}),
+		Array: w.MustNewArrayValue("array", func(ew writer.ElementWriter) error {
+			if err := ew.WriteElement(1); err != nil {
+				return err
+			}
+			return ew.WriteElementFunc(func(w io.Writer) error {
+				return writer.ErrOmitValue
+			})
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Omitted":null,"OmittedCtx":null,"Array":[1,null]}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+
+	// it is an error once something has been written.
+	w = writer.New(new(bytes.Buffer))
+	v := w.MustNewValue("partial", func(w io.Writer) error {
+		if _, err := w.Write([]byte("[")); err != nil {
+			return err
+		}
+		return writer.ErrOmitValue
+	})
+
+	if err := json.NewEncoder(w).Encode(v); !errors.Is(err, writer.ErrOmitValue) {
+		t.Fatalf("ErrOmitValue expected, but was %v", err)
+	}
+}
+
+func TestWriteElements(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	v := w.MustNewArrayValue("items", func(w writer.ElementWriter) error {
+		if err := w.WriteElement(0); err != nil {
+			return err
+		}
+		if err := w.WriteElements(1, "two", nil, []int{3}); err != nil {
+			return err
+		}
+		// nothing is written for no elements.
+		return w.WriteElements()
+	})
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `[0,1,"two",null,[3]]` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+
+	// the failing index is reported.
+	w = writer.New(new(bytes.Buffer))
+	v = w.MustNewArrayValue("items", func(w writer.ElementWriter) error {
+		return w.WriteElements(1, 2, make(chan int))
+	})
+
+	err := json.NewEncoder(w).Encode(v)
+	if err == nil || !strings.Contains(err.Error(), "element 2:") || strings.Count(err.Error(), "element") != 1 {
+		t.Fatalf("error with the index expected, but was %v", err)
+	}
+	var typeErr *json.UnsupportedTypeError
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("json.UnsupportedTypeError expected, but was %v", err)
+	}
+}
+
+func TestWriteElementIndex(t *testing.T) {
+	w := writer.New(new(bytes.Buffer), writer.WithSkipNilElements())
+
+	v := w.MustNewArrayValue("items", func(w writer.ElementWriter) error {
+		// skipped elements are not counted.
+		for _, e := range []interface{}{1, nil, "two", make(chan int)} {
+			if err := w.WriteElement(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	err := json.NewEncoder(w).Encode(v)
+	if err == nil || !strings.Contains(err.Error(), `streaming value "items": element 2: `) {
+		t.Fatalf("error with the key and the index expected, but was %v", err)
+	}
+	var typeErr *json.UnsupportedTypeError
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("json.UnsupportedTypeError expected, but was %v", err)
+	}
+}
+
+func TestWriteElementNoDanglingSeparator(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	v := w.MustNewArrayValue("items", func(w writer.ElementWriter) error {
+		// the error is returned and ignored.
+		_ = w.WriteElements(1, make(chan int))
+		return w.WriteElement(2)
+	})
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := "[1,2]\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+
+	// the partial output of a failed array has no dangling separator.
+	buf.Reset()
+	v = w.MustNewArrayValue("failed", func(w writer.ElementWriter) error {
+		return w.WriteElements(1, make(chan int))
+	})
+
+	if err := json.NewEncoder(w).Encode(v); err == nil {
+		t.Fatal("error expected")
+	}
+
+	if expected, actual := "[1", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestElementCount(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithSkipNilElements())
+
+	const limit = 3
+	var counts []int
+	v := w.MustNewArrayValue("items", func(w writer.ElementWriter) error {
+		for _, e := range []interface{}{1, nil, 2, json.RawMessage("3"), 4, 5} {
+			if w.Count() >= limit {
+				break
+			}
+			if raw, ok := e.(json.RawMessage); ok {
+				if err := w.WriteRawElement(raw); err != nil {
+					return err
+				}
+			} else if err := w.WriteElement(e); err != nil {
+				return err
+			}
+			counts = append(counts, w.Count())
+		}
+		return nil
+	})
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := "[1,2,3]\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+	if expected := []int{1, 1, 2, 3}; !reflect.DeepEqual(counts, expected) {
+		t.Fatalf("counts expected:%v, but was %v", expected, counts)
+	}
+}
+
+func TestWriteElementFunc(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	const size = 4 * 1024 * 1024
+
+	root := struct {
+		Items *writer.Value
+	}{
+		Items: w.MustNewArrayValue("items", func(ew writer.ElementWriter) error {
+			if err := ew.WriteElement(1); err != nil {
+				return err
+			}
+			if err := ew.WriteElementFunc(func(w io.Writer) error {
+				if _, err := w.Write([]byte(`"`)); err != nil {
+					return err
+				}
+				chunk := bytes.Repeat([]byte("a"), 1024)
+				for i := 0; i < size/len(chunk); i++ {
+					if _, err := w.Write(chunk); err != nil {
+						return err
+					}
+				}
+				_, err := w.Write([]byte(`"`))
+				return err
+			}); err != nil {
+				return err
+			}
+			return ew.WriteElement(true)
+		}),
+	}
+
+	if err := json.NewEncoder(w).Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"Items":[1,"` + strings.Repeat("a", size) + `",true]}` + "\n"
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("result expected %d bytes, but was %d bytes", len(expected), len(actual))
+	}
+}
+
+func TestEncode(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithIndent("", " "))
+
+	root := struct {
+		Array *writer.Value
+	}{
+		Array: w.MustNewArrayValue("array", func(w writer.ElementWriter) error {
+			return w.WriteElement(1)
+		}),
+	}
+
+	if err := w.Encode(&root); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := "{\n \"Array\": [\n  1\n ]\n}\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+
+	// a failed document doesn't affect the next one.
+	buf.Reset()
+	failed := struct {
+		Value *writer.Value
+	}{
+		Value: w.MustNewValue("failed", func(w io.Writer) error {
+			_, err := w.Write([]byte(`"`))
+			if err != nil {
+				return err
+			}
+			return errors.New("failure")
+		}),
+	}
+	if err := w.Encode(&failed); err == nil {
+		t.Fatal("error expected")
+	}
+
+	buf.Reset()
+	if err := w.Encode([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "[\n \"a\"\n]\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestEncodeAfterScanError(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf, writer.WithMaxNestingDepth(2))
+
+	if err := w.Encode([][][]int{{{1}}}); err == nil {
+		t.Fatal("error expected")
+	}
+
+	// the nesting of the failed document doesn't remain.
+	buf.Reset()
+	if err := w.Encode([]int{1}); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "[1]\n", buf.String(); actual != expected {
+		t.Fatalf("result expected:%s, but was %s", expected, actual)
+	}
+}
+
+func TestWriteAlternativeEscaping(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := writer.New(buf)
+
+	w.MustNewValue("key", func(w io.Writer) error {
+		_, err := w.Write([]byte("1"))
+		return err
+	})
+
+	// the same string as the placeholder of "key", in which the backslash is escaped by \u.
+	doc := `{"Value":"\u005c🎏key"}`
+	var s map[string]string
+	if err := json.Unmarshal([]byte(doc), &s); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := writer.Sentinel()+"key", s["Value"]; actual != expected {
+		t.Fatalf("decoded expected:%s, but was %s", expected, actual)
+	}
+
+	if _, err := w.Write([]byte(doc)); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the exact byte sequence is detected.
+	if actual := buf.String(); actual != doc {
+		t.Fatalf("result expected:%s, but was %s", doc, actual)
+	}
+}